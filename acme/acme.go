@@ -2,8 +2,13 @@
 package acme
 
 import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"log"
 	"path"
+	"time"
 
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
@@ -57,3 +62,56 @@ func (c Config) Manager() (*autocert.Manager, error) {
 		Client:     &acme.Client{DirectoryURL: c.Server},
 	}, nil
 }
+
+// A CertStatus describes the certificate cached for a domain.
+type CertStatus struct {
+	Domain    string    `json:"domain"`
+	NotBefore time.Time `json:"not_before,omitempty"`
+	NotAfter  time.Time `json:"not_after,omitempty"`
+
+	// Error is set if there's no usable certificate for the domain.
+	Error string `json:"error,omitempty"`
+}
+
+// Certificates returns the status of the certificates cached for each of
+// c.Domains.
+func (c Config) Certificates(ctx context.Context) []CertStatus {
+	cache := autocert.DirCache(path.Join(c.DataPath, "autocert"))
+	statuses := make([]CertStatus, len(c.Domains))
+	for i, domain := range c.Domains {
+		statuses[i] = CertStatus{Domain: domain}
+		cert, err := cachedCert(ctx, cache, domain)
+		if err != nil {
+			statuses[i].Error = err.Error()
+			continue
+		}
+		statuses[i].NotBefore, statuses[i].NotAfter = cert.NotBefore, cert.NotAfter
+	}
+	return statuses
+}
+
+// cachedCert returns the leaf certificate cached for domain.  autocert caches
+// ECDSA certificates under the domain, and RSA ones under domain+"+rsa".
+func cachedCert(ctx context.Context, cache autocert.Cache, domain string) (*x509.Certificate, error) {
+	data, err := cache.Get(ctx, domain)
+	if err == autocert.ErrCacheMiss {
+		data, err = cache.Get(ctx, domain+"+rsa")
+	}
+	if err == autocert.ErrCacheMiss {
+		return nil, errors.New("no certificate has been provisioned")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no certificate found in cache")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
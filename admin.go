@@ -0,0 +1,274 @@
+package sohop
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/davars/sohop/acme"
+	"github.com/davars/sohop/audit"
+	"github.com/davars/sohop/globals"
+	"github.com/davars/sohop/state"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const defaultAdminSubdomain = "admin"
+
+// AdminConfig configures the admin API, served on its own subdomain to users
+// allowed by Policy.
+type AdminConfig struct {
+	// Subdomain is the subdomain of Config.Domain that serves the admin API.
+	// Defaults to "admin".  It can't also be the name of an upstream.
+	Subdomain string
+
+	// Policy restricts which authenticated users may use the admin API.  It's
+	// required.
+	Policy *Policy
+}
+
+func (c *AdminConfig) subdomain() string {
+	if c.Subdomain == "" {
+		return defaultAdminSubdomain
+	}
+	return c.Subdomain
+}
+
+type adminUpstream struct {
+	URLs      []string      `json:"urls,omitempty"`
+	WebSocket string        `json:"websocket,omitempty"`
+	Routes    []string      `json:"routes,omitempty"`
+	Auth      bool          `json:"auth"`
+	Policy    *Policy       `json:"policy,omitempty"`
+	OK        bool          `json:"ok"`
+	Health    *healthStatus `json:"health,omitempty"`
+}
+
+type adminSession struct {
+	Key             string    `json:"key"`
+	User            string    `json:"user"`
+	Email           string    `json:"email,omitempty"`
+	Groups          []string  `json:"groups,omitempty"`
+	AuthenticatedAt time.Time `json:"authenticated_at"`
+	ExpiresAt       time.Time `json:"expires_at"`
+}
+
+// AdminHandler serves the admin API:
+//
+//	GET    /upstreams        the configured upstreams and their health
+//	POST   /health           check the upstreams now, and respond with the report
+//	GET    /certs            the status of the server's certificates
+//	GET    /sessions         the active sessions (?user= filters by user)
+//	DELETE /sessions         revoke all of the sessions of ?user=
+//	DELETE /sessions/{key}   revoke a single session
+//	GET    /metrics          metrics in the Prometheus format
+//
+// Sessions can only be listed and revoked if they're kept on the server (see
+// SessionStoreConfig).  AdminHandler doesn't authenticate or authorize
+// requests.
+func (s Server) AdminHandler() http.Handler {
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+
+	router.Path("/upstreams").Methods("GET").HandlerFunc(s.adminUpstreams)
+	router.Path("/health").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.performCheck()
+		s.HealthHandler().ServeHTTP(w, r)
+	})
+	router.Path("/certs").Methods("GET").HandlerFunc(s.adminCerts)
+	router.Path("/sessions").Methods("GET").HandlerFunc(s.adminSessions)
+	router.Path("/sessions").Methods("DELETE").HandlerFunc(s.adminRevokeUser)
+	router.Path("/sessions/{key}").Methods("DELETE").HandlerFunc(s.adminRevoke)
+	router.Path("/metrics").Methods("GET").Handler(promhttp.Handler())
+
+	return router
+}
+
+// adminAuthorizing returns a middleware that only allows users matching the
+// admin Policy.  It must run after authentication.
+func (s Server) adminAuthorizing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := s.storeConfig.GetSession(r)
+		setUser(r, session.User)
+		if err := s.Config.Admin.Policy.allows(session.User, session.Email, session.Groups); err != nil {
+			denied(w, r, s.Config.Admin.subdomain(), session.User, "https://"+r.Host+r.RequestURI, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		globals.Logger(r.Context()).Error("admin", "error", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	writeJSON(w, r, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+func (s Server) adminUpstreams(w http.ResponseWriter, r *http.Request) {
+	s.health.RLock()
+	health := s.health.upstreams
+	s.health.RUnlock()
+
+	upstreams := make(map[string]adminUpstream, len(s.Config.Upstreams))
+	for name, spec := range s.Config.Upstreams {
+		upstream := adminUpstream{
+			URLs:      RouteConfig{URL: spec.URL, URLs: spec.URLs}.urls(),
+			WebSocket: spec.WebSocket,
+			Auth:      spec.requiresAuth(),
+			Policy:    spec.Policy,
+		}
+		for _, rt := range spec.Routes {
+			upstream.Routes = append(upstream.Routes, rt.Path)
+		}
+		if status, ok := health[name]; ok {
+			upstream.Health = &status
+			upstream.OK = status.ok
+		}
+		upstreams[name] = upstream
+	}
+	writeJSON(w, r, http.StatusOK, upstreams)
+}
+
+func (s Server) adminCerts(w http.ResponseWriter, r *http.Request) {
+	if s.Config.Acme != nil {
+		c := *s.Config.Acme
+		c.Domains = s.Config.acmeDomains()
+		sort.Strings(c.Domains)
+		writeJSON(w, r, http.StatusOK, c.Certificates(r.Context()))
+		return
+	}
+
+	status := acme.CertStatus{Domain: s.Config.Domain}
+	data, err := ioutil.ReadFile(s.Config.TLS.CertFile)
+	if err == nil {
+		var cert *x509.Certificate
+		cert, err = parseCert(data)
+		if err == nil {
+			if len(cert.DNSNames) > 0 {
+				status.Domain = strings.Join(cert.DNSNames, ",")
+			}
+			status.NotBefore, status.NotAfter = cert.NotBefore, cert.NotAfter
+		}
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	writeJSON(w, r, http.StatusOK, []acme.CertStatus{status})
+}
+
+// manager returns the session store if sessions are kept on the server.
+func (s Server) manager() (state.Manager, error) {
+	m, ok := s.storeConfig.(state.Manager)
+	if !ok {
+		return nil, ErrSessionsNotStored
+	}
+	return m, nil
+}
+
+func (s Server) adminSessions(w http.ResponseWriter, r *http.Request) {
+	m, err := s.manager()
+	if err != nil {
+		writeJSONError(w, r, http.StatusNotImplemented, err)
+		return
+	}
+	sessions, err := m.Sessions()
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	user := r.URL.Query().Get("user")
+	list := []adminSession{}
+	for key, session := range sessions {
+		if user != "" && !strings.EqualFold(session.User, user) {
+			continue
+		}
+		list = append(list, adminSession{
+			Key:             key,
+			User:            session.User,
+			Email:           session.Email,
+			Groups:          session.Groups,
+			AuthenticatedAt: session.AuthenticatedAt.AsTime(),
+			ExpiresAt:       session.ExpiresAt.AsTime(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].User != list[j].User {
+			return list[i].User < list[j].User
+		}
+		return list[i].AuthenticatedAt.Before(list[j].AuthenticatedAt)
+	})
+	writeJSON(w, r, http.StatusOK, list)
+}
+
+func (s Server) adminRevokeUser(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		writeJSONError(w, r, http.StatusBadRequest, errors.New("user is required"))
+		return
+	}
+	m, err := s.manager()
+	if err != nil {
+		writeJSONError(w, r, http.StatusNotImplemented, err)
+		return
+	}
+	n, err := m.RevokeUser(user)
+	if n > 0 || err == nil {
+		s.revoked(r, user, n)
+	}
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, struct {
+		Revoked int `json:"revoked"`
+	}{n})
+}
+
+func (s Server) adminRevoke(w http.ResponseWriter, r *http.Request) {
+	m, err := s.manager()
+	if err != nil {
+		writeJSONError(w, r, http.StatusNotImplemented, err)
+		return
+	}
+	key := mux.Vars(r)["key"]
+	sessions, err := m.Sessions()
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	session, ok := sessions[key]
+	if !ok {
+		writeJSONError(w, r, http.StatusNotFound, errors.New("session not found"))
+		return
+	}
+	if err := m.Revoke(key); err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.revoked(r, session.User, 1)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revoked logs and audits the revocation of n of user's sessions by the
+// administrator making r.
+func (s Server) revoked(r *http.Request, user string, n int) {
+	by := s.storeConfig.GetSession(r).User
+	globals.Logger(r.Context()).Info("sessions revoked", "user", user, "sessions", n, "by", by)
+	audit.Record(r, audit.Event{Event: audit.Revoked, User: user, By: by})
+}
@@ -0,0 +1,108 @@
+package sohop
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/davars/sohop/audit"
+	"github.com/davars/sohop/auth"
+	"github.com/davars/sohop/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminHandler(t *testing.T) {
+	foo := dummyBackend("foo")
+	defer foo.Close()
+
+	buf := &bytes.Buffer{}
+	s := &Server{Config: &Config{
+		Domain:    "example.com",
+		Upstreams: map[string]UpstreamConfig{"foo": {URL: foo.URL, Auth: true}},
+		Auth:      auth.Config{Type: "mock", Config: json.RawMessage(`{"ClientSecret": "hunter2"}`)},
+		TLS:       TLSConfig{CertFile: "fixtures/cert.pem", CertKey: "fixtures/key.pem"},
+		Session:   SessionConfig{Store: SessionStoreConfig{Type: StoreMemory}},
+		Admin:     &AdminConfig{Policy: &Policy{Users: []string{"root"}}},
+	}}
+	live := s.reloadable()
+	// Reload keeps the audit log if its path ("") hasn't changed.
+	live.audit = audit.New(buf)
+	require.NoError(t, s.Reload(s.Config))
+	s.current().performCheck()
+
+	store, err := s.current().Config.storeConfig(s.current().sessions)
+	require.NoError(t, err)
+	root := authorizedRequest(t, store, "https://admin.example.com/", &state.Identity{User: "root"}).Cookies()
+	guest := authorizedRequest(t, store, "https://admin.example.com/", &state.Identity{User: "guest"}).Cookies()
+	authorizedRequest(t, store, "https://admin.example.com/", &state.Identity{User: "guest"})
+	buf.Reset()
+
+	request := func(method, path string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "https://admin.example.com"+path, nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rw := httptest.NewRecorder()
+		live.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// Only users allowed by the policy can use the API.
+	assert.Equal(t, http.StatusFound, request("GET", "/upstreams", nil).Code)
+	assert.Equal(t, http.StatusForbidden, request("GET", "/upstreams", guest).Code)
+
+	rw := request("GET", "/upstreams", root)
+	require.Equal(t, http.StatusOK, rw.Code)
+	var upstreams map[string]adminUpstream
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &upstreams))
+	assert.Equal(t, []string{foo.URL}, upstreams["foo"].URLs)
+	assert.True(t, upstreams["foo"].Auth)
+	assert.True(t, upstreams["foo"].OK)
+	assert.Equal(t, "200 OK", upstreams["foo"].Health.Response)
+
+	// The fixture certificate has expired, so the check fails.
+	rw = request("POST", "/health", root)
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Contains(t, rw.Body.String(), `"foo"`)
+
+	rw = request("GET", "/certs", root)
+	require.Equal(t, http.StatusOK, rw.Code)
+	var certs []struct{ Error string }
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &certs))
+	require.Len(t, certs, 1)
+	assert.Empty(t, certs[0].Error)
+
+	rw = request("GET", "/sessions?user=guest", root)
+	require.Equal(t, http.StatusOK, rw.Code)
+	var sessions []adminSession
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &sessions))
+	require.Len(t, sessions, 2)
+	assert.Equal(t, "guest", sessions[0].User)
+
+	assert.Equal(t, http.StatusNotFound, request("DELETE", "/sessions/missing", root).Code)
+	assert.Equal(t, http.StatusNoContent, request("DELETE", "/sessions/"+sessions[0].Key, root).Code)
+
+	buf.Reset()
+	rw = request("DELETE", "/sessions?user=guest", root)
+	require.Equal(t, http.StatusOK, rw.Code)
+	assert.JSONEq(t, `{"revoked": 1}`, rw.Body.String())
+	assert.Equal(t, http.StatusFound, request("GET", "/upstreams", guest).Code)
+
+	var event audit.Event
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &event))
+	assert.Equal(t, audit.Revoked, event.Event)
+	assert.Equal(t, "guest", event.User)
+	assert.Equal(t, "root", event.By)
+
+	// Sessions kept in cookies can't be listed.
+	c := *s.Config
+	c.Session = SessionConfig{}
+	require.NoError(t, s.Reload(&c))
+	store, err = s.current().Config.storeConfig(nil)
+	require.NoError(t, err)
+	root = authorizedRequest(t, store, "https://admin.example.com/", &state.Identity{User: "root"}).Cookies()
+	assert.Equal(t, http.StatusNotImplemented, request("GET", "/sessions", root).Code)
+}
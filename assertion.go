@@ -0,0 +1,269 @@
+package sohop
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/davars/sohop/globals"
+	"github.com/davars/sohop/state"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const (
+	defaultAssertionHeader = "X-Sohop-Assertion"
+	defaultAssertionTTL    = time.Minute
+)
+
+// AssertionConfig configures the keys used to sign identity assertions (see
+// UpstreamConfig.Assertion).  The public keys are published as a JWK Set at
+// https://oauth.<Domain>/.well-known/jwks.json.
+type AssertionConfig struct {
+	// KeyFile is a path to one or more PEM-encoded private keys (ECDSA, RSA
+	// or Ed25519).  The first is used to sign assertions; all of them are
+	// published, so keys can be rotated.  The file is read again when the
+	// config is reloaded.
+	//
+	// If not set, an ECDSA key is generated when an upstream first needs one,
+	// and kept across reloads.  Replicas each generate their own, so they
+	// should share a KeyFile instead.
+	KeyFile string
+
+	// Issuer is the assertions' "iss" claim.  Defaults to
+	// "https://oauth.<Domain>".
+	Issuer string
+}
+
+// UpstreamAssertionConfig configures the identity assertion sent to an
+// upstream: a short-lived JWT identifying the user, signed by sohop.
+type UpstreamAssertionConfig struct {
+	// Header is the request header the assertion is sent in.  Defaults to
+	// "X-Sohop-Assertion".  Any value sent by the client is removed.
+	Header string
+
+	// Audience is the assertion's "aud" claim.  Defaults to the upstream's
+	// URL, "https://<subdomain>.<Domain>".
+	Audience string
+
+	// TTL is how long the assertion is valid for.  Defaults to a minute.
+	TTL Duration
+}
+
+func (c *UpstreamAssertionConfig) header() string {
+	if c.Header == "" {
+		return defaultAssertionHeader
+	}
+	return http.CanonicalHeaderKey(c.Header)
+}
+
+func (c *UpstreamAssertionConfig) ttl() time.Duration {
+	if c.TTL == 0 {
+		return defaultAssertionTTL
+	}
+	return time.Duration(c.TTL)
+}
+
+// assertionClaims are the claims of an identity assertion.
+type assertionClaims struct {
+	jwt.Claims
+	Email    string            `json:"email,omitempty"`
+	Name     string            `json:"name,omitempty"`
+	Groups   []string          `json:"groups,omitempty"`
+	AuthTime *jwt.NumericDate  `json:"auth_time,omitempty"`
+	Extra    map[string]string `json:"claims,omitempty"`
+}
+
+// assertionKeys signs identity assertions.
+type assertionKeys struct {
+	signer jose.Signer
+
+	// public is the JWK Set of the public keys.
+	public jose.JSONWebKeySet
+
+	// generated is whether the key was generated rather than read from
+	// KeyFile, in which case it's kept across reloads.
+	generated bool
+}
+
+// assertionKeys returns the keys for signing assertions, or nil if they
+// aren't needed.  prev are the keys of the previous config, which are kept if
+// they were generated and Assertion.KeyFile still isn't set.
+func (c *Config) assertionKeys(prev *assertionKeys) (*assertionKeys, error) {
+	if c.Assertion.KeyFile != "" {
+		return c.Assertion.readKeys()
+	}
+	if prev != nil && prev.generated {
+		return prev, nil
+	}
+	for _, spec := range c.Upstreams {
+		if spec.Assertion == nil {
+			continue
+		}
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		k, err := newAssertionKeys([]crypto.Signer{key})
+		if err != nil {
+			return nil, err
+		}
+		k.generated = true
+		return k, nil
+	}
+	return nil, nil
+}
+
+// readKeys returns the keys in KeyFile.
+func (c AssertionConfig) readKeys() (*assertionKeys, error) {
+	data, err := os.ReadFile(c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var keys []crypto.Signer
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		key, err := parsePrivateKey(block)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no private keys found in %s", c.KeyFile)
+	}
+	return newAssertionKeys(keys)
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// signatureAlgorithm returns the JWS algorithm used with key.
+func signatureAlgorithm(key crypto.Signer) (jose.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return "", errors.New("RSA keys must be at least 2048 bits")
+		}
+		return jose.RS256, nil
+	case ed25519.PrivateKey:
+		return jose.EdDSA, nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
+
+func newAssertionKeys(keys []crypto.Signer) (*assertionKeys, error) {
+	k := &assertionKeys{}
+	for i, key := range keys {
+		alg, err := signatureAlgorithm(key)
+		if err != nil {
+			return nil, err
+		}
+		jwk := jose.JSONWebKey{Key: key.Public(), Algorithm: string(alg), Use: "sig"}
+		thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+		k.public.Keys = append(k.public.Keys, jwk)
+
+		if i == 0 {
+			k.signer, err = jose.NewSigner(jose.SigningKey{
+				Algorithm: alg,
+				Key:       jose.JSONWebKey{Key: key, KeyID: jwk.KeyID},
+			}, (&jose.SignerOptions{}).WithType("JWT"))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return k, nil
+}
+
+// sign returns an assertion of the identity of session's user.
+func (k *assertionKeys) sign(issuer, audience string, ttl time.Duration, session *state.Session) (string, error) {
+	now := globals.Clock.Now()
+	claims := assertionClaims{
+		Claims: jwt.Claims{
+			Issuer:    issuer,
+			Subject:   session.User,
+			Audience:  jwt.Audience{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Expiry:    jwt.NewNumericDate(now.Add(ttl)),
+		},
+		Email:  session.Email,
+		Name:   session.Name,
+		Groups: session.Groups,
+		Extra:  session.Claims,
+	}
+	if session.AuthenticatedAt != nil {
+		claims.AuthTime = jwt.NewNumericDate(session.AuthenticatedAt.AsTime())
+	}
+	return jwt.Signed(k.signer).Claims(claims).Serialize()
+}
+
+// assertionIssuer returns the issuer of identity assertions.
+func (c *Config) assertionIssuer() string {
+	if c.Assertion.Issuer != "" {
+		return c.Assertion.Issuer
+	}
+	return "https://oauth." + c.Domain
+}
+
+// JWKSHandler serves the public keys used to sign identity assertions, as a
+// JWK Set.
+func (s Server) JWKSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{}}
+		if s.assertions != nil {
+			keys = s.assertions.public
+		}
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		writeJSON(w, r, http.StatusOK, keys)
+	})
+}
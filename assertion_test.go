@@ -0,0 +1,110 @@
+package sohop
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/davars/sohop/auth"
+	"github.com/davars/sohop/state"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssertion(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Identity"))
+	}))
+	defer upstream.Close()
+
+	config := func() *Config {
+		return &Config{
+			Domain: "example.com",
+			Upstreams: map[string]UpstreamConfig{
+				"app": {URL: upstream.URL, Auth: true, Assertion: &UpstreamAssertionConfig{Header: "x-identity"}},
+				"public": {URL: upstream.URL, Assertion: &UpstreamAssertionConfig{
+					Header:   "X-Identity",
+					Audience: "public-api",
+					TTL:      Duration(time.Hour),
+				}},
+			},
+			Auth:   auth.Config{Type: "mock", Config: json.RawMessage(`{"ClientSecret": "hunter2"}`)},
+			TLS:    TLSConfig{CertFile: "fixtures/cert.pem", CertKey: "fixtures/key.pem"},
+			Cookie: CookieConfig{Secret: "3c0767ada2466a92a59c1214061441713aeafe6d115e29aa376c0f9758cdf0f5"},
+		}
+	}
+	s := &Server{Config: config()}
+	require.NoError(t, s.Reload(s.Config))
+	store, err := s.current().Config.storeConfig(nil)
+	require.NoError(t, err)
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		s.reloadable().ServeHTTP(rw, req)
+		return rw
+	}
+	jwks := func() jose.JSONWebKeySet {
+		rw := serve(httptest.NewRequest("GET", "https://oauth.example.com/.well-known/jwks.json", nil))
+		require.Equal(t, http.StatusOK, rw.Code)
+		var keys jose.JSONWebKeySet
+		require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &keys))
+		return keys
+	}
+	verify := func(assertion string, keys jose.JSONWebKeySet, audience string) assertionClaims {
+		token, err := jwt.ParseSigned(assertion, []jose.SignatureAlgorithm{jose.ES256, jose.RS256})
+		require.NoError(t, err)
+		require.Len(t, token.Headers, 1)
+		matching := keys.Key(token.Headers[0].KeyID)
+		require.Len(t, matching, 1)
+		var claims assertionClaims
+		require.NoError(t, token.Claims(matching[0].Key, &claims))
+		require.NoError(t, claims.Validate(jwt.Expected{
+			Issuer:      "https://oauth.example.com",
+			AnyAudience: jwt.Audience{audience},
+			Time:        time.Now(),
+		}))
+		return claims
+	}
+
+	keys := jwks()
+	require.Len(t, keys.Keys, 1)
+	assert.Equal(t, "ES256", keys.Keys[0].Algorithm)
+	assert.True(t, keys.Keys[0].IsPublic())
+
+	req := authorizedRequest(t, store, "https://app.example.com/", &state.Identity{User: "octocat", Email: "octocat@example.com", Groups: []string{"staff"}})
+	req.Header.Set("X-Identity", "forged")
+	rw := serve(req)
+	require.Equal(t, http.StatusOK, rw.Code)
+	claims := verify(rw.Body.String(), keys, "https://app.example.com")
+	assert.Equal(t, "octocat", claims.Subject)
+	assert.Equal(t, "octocat@example.com", claims.Email)
+	assert.Equal(t, []string{"staff"}, claims.Groups)
+	assert.NotNil(t, claims.AuthTime)
+	assert.Equal(t, time.Minute, claims.Expiry.Time().Sub(claims.IssuedAt.Time()))
+
+	claims = verify(serve(authorizedRequest(t, store, "https://public.example.com/", &state.Identity{User: "octocat"})).Body.String(), keys, "public-api")
+	assert.Equal(t, time.Hour, claims.Expiry.Time().Sub(claims.IssuedAt.Time()))
+
+	// Anonymous users don't get an assertion, or keep the one they sent.
+	req = httptest.NewRequest("GET", "https://public.example.com/", nil)
+	req.Header.Set("X-Identity", "forged")
+	assert.Empty(t, serve(req).Body.String())
+
+	// The generated key is kept across reloads.
+	require.NoError(t, s.Reload(config()))
+	assert.Equal(t, keys.Keys[0].KeyID, jwks().Keys[0].KeyID)
+
+	c := config()
+	c.Assertion = AssertionConfig{KeyFile: "fixtures/key.pem", Issuer: "https://oauth.example.com"}
+	require.NoError(t, s.Reload(c))
+	keys = jwks()
+	require.Len(t, keys.Keys, 1)
+	assert.Equal(t, "RS256", keys.Keys[0].Algorithm)
+	rw = serve(authorizedRequest(t, store, "https://app.example.com/", &state.Identity{User: "octocat"}))
+	assert.Equal(t, "octocat", verify(rw.Body.String(), keys, "https://app.example.com").Subject)
+}
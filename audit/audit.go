@@ -0,0 +1,144 @@
+// Package audit records authentication and authorization decisions as JSON
+// lines, one Event per line.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/davars/sohop/globals"
+)
+
+// Events recorded in the audit log.
+const (
+	Login        = "login"
+	LoginFailed  = "login_failed"
+	Logout       = "logout"
+	AccessDenied = "access_denied"
+	Revoked      = "sessions_revoked"
+)
+
+// An Event is a single entry in the audit log.
+type Event struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+
+	// Reason explains why a login failed or access was denied.
+	Reason string `json:"reason,omitempty"`
+
+	// Error is the error that caused the failure, if any.
+	Error string `json:"error,omitempty"`
+
+	// User is the user the event applies to, if known.
+	User string `json:"user,omitempty"`
+
+	// By is the administrator who revoked the user's sessions.
+	By string `json:"by,omitempty"`
+
+	// Upstream is the upstream the user tried to access, and URL the URL.
+	Upstream string `json:"upstream,omitempty"`
+	URL      string `json:"url,omitempty"`
+
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// A Log writes events to a file or stdout.
+type Log struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	path   string
+}
+
+// Open opens the audit log at path, appending to it if it already exists.
+// If path is "-" events are written to stdout.
+func Open(path string) (*Log, error) {
+	if path == "-" {
+		return &Log{w: os.Stdout, path: path}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{w: f, closer: f, path: path}, nil
+}
+
+// New returns a Log that writes to w.
+func New(w io.Writer) *Log {
+	return &Log{w: w}
+}
+
+// Path returns the path the log was opened with.
+func (l *Log) Path() string {
+	return l.path
+}
+
+// Close closes the log's file.
+func (l *Log) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closer.Close()
+}
+
+// Record writes e to the log, filling in its time and the client's details
+// from r.  A nil Log discards events.
+func (l *Log) Record(r *http.Request, e Event) {
+	if l == nil {
+		return
+	}
+
+	e.Time = globals.Clock.Now().UTC()
+	e.IP = clientIP(r)
+	e.UserAgent = r.UserAgent()
+	e.RequestID = r.Header.Get("X-Request-ID")
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		globals.Logger(r.Context()).Error("audit", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(line); err != nil {
+		globals.Logger(r.Context()).Error("audit", "error", err)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type logKey struct{}
+
+// NewContext returns a copy of ctx carrying l.
+func NewContext(ctx context.Context, l *Log) context.Context {
+	return context.WithValue(ctx, logKey{}, l)
+}
+
+// FromContext returns the Log carried by ctx, or nil if there isn't one.
+func FromContext(ctx context.Context) *Log {
+	l, _ := ctx.Value(logKey{}).(*Log)
+	return l
+}
+
+// Record writes e to the Log carried by r's context, if any.
+func Record(r *http.Request, e Event) {
+	FromContext(r.Context()).Record(r, e)
+}
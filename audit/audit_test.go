@@ -0,0 +1,49 @@
+package audit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	req := httptest.NewRequest("GET", "https://oauth.example.com/authorized", nil)
+	req.RemoteAddr = "192.0.2.7:54321"
+	req.Header.Set("User-Agent", "curl/8.0")
+	req.Header.Set("X-Request-ID", "abc")
+
+	for i := 0; i < 2; i++ {
+		l, err := Open(path)
+		require.NoError(t, err)
+		Record(req.WithContext(NewContext(req.Context(), l)), Event{Event: Login, User: "someone"})
+		require.NoError(t, l.Close())
+	}
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2, "the log should be appended to")
+
+	var event Event
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &event))
+	assert.False(t, event.Time.IsZero())
+	assert.Equal(t, Login, event.Event)
+	assert.Equal(t, "someone", event.User)
+	assert.Equal(t, "192.0.2.7", event.IP)
+	assert.Equal(t, "curl/8.0", event.UserAgent)
+	assert.Equal(t, "abc", event.RequestID)
+
+	// Without a Log, events are discarded.
+	var nilLog *Log
+	nilLog.Record(req, Event{Event: Logout})
+	Record(req, Event{Event: Logout})
+	assert.NoError(t, nilLog.Close())
+}
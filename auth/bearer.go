@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/davars/sohop/globals"
+	"github.com/davars/sohop/state"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// An APIKey is a static bearer credential for a user.
+type APIKey struct {
+	// Hash is the hex-encoded SHA-256 hash of the key (see NewAPIKey).
+	Hash string
+
+	// User, Email and Groups identify the user the key belongs to, as an
+	// auth provider would.
+	User   string
+	Email  string
+	Groups []string
+}
+
+// NewAPIKey returns a new random API key and its hash.
+func NewAPIKey() (key, hash string, err error) {
+	var b [32]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return "", "", err
+	}
+	key = base64.RawURLEncoding.EncodeToString(b[:])
+	h := sha256.Sum256([]byte(key))
+	return key, hex.EncodeToString(h[:]), nil
+}
+
+// bearerClaims are the claims of the tokens minted by BearerAuth.
+type bearerClaims struct {
+	jwt.Claims
+	Email  string   `json:"email,omitempty"`
+	Name   string   `json:"name,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// A BearerAuth authenticates requests with an "Authorization: Bearer"
+// header, for clients that can't log in interactively.  The credential is
+// either an API key, or a token minted by the BearerAuth.
+type BearerAuth struct {
+	keys     map[[sha256.Size]byte]*state.Identity
+	secret   []byte
+	audience string
+}
+
+// NewBearerAuth returns a BearerAuth that accepts keys, and tokens signed with
+// tokenSecret (a hex-encoded 32 byte key) for audience, typically the domain.
+// If tokenSecret is "", only API keys are accepted.
+func NewBearerAuth(keys []APIKey, tokenSecret, audience string) (*BearerAuth, error) {
+	b := &BearerAuth{keys: map[[sha256.Size]byte]*state.Identity{}, audience: audience}
+	for i, k := range keys {
+		hash, err := hex.DecodeString(k.Hash)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("API key %d: hash should be a 64-character hex-encoded SHA-256 hash", i)
+		}
+		if k.User == "" {
+			return nil, fmt.Errorf("API key %d: user is required", i)
+		}
+		b.keys[[sha256.Size]byte(hash)] = &state.Identity{User: k.User, Email: k.Email, Groups: k.Groups}
+	}
+	if tokenSecret != "" {
+		secret, err := hex.DecodeString(tokenSecret)
+		if err != nil || len(secret) != 32 {
+			return nil, errors.New("token secret should be a 64-character hex-encoded string")
+		}
+		b.secret = secret
+	}
+	return b, nil
+}
+
+// Mint returns a token identifying id that expires after ttl.
+func (b *BearerAuth) Mint(id *state.Identity, ttl time.Duration) (string, error) {
+	if b.secret == nil {
+		return "", errors.New("no token secret is configured")
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: b.secret}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+	now := globals.Clock.Now()
+	claims := bearerClaims{
+		Claims: jwt.Claims{
+			Subject:  id.User,
+			Audience: jwt.Audience{b.audience},
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(ttl)),
+		},
+		Email:  id.Email,
+		Name:   id.Name,
+		Groups: id.Groups,
+	}
+	return jwt.Signed(signer).Claims(claims).Serialize()
+}
+
+// Identify returns the identity of the user the credential belongs to.
+func (b *BearerAuth) Identify(credential string) (*state.Identity, error) {
+	if id, ok := b.keys[sha256.Sum256([]byte(credential))]; ok {
+		return id, nil
+	}
+
+	if b.secret == nil || strings.Count(credential, ".") != 2 {
+		return nil, errors.New("unknown API key")
+	}
+	token, err := jwt.ParseSigned(credential, []jose.SignatureAlgorithm{jose.HS256})
+	if err != nil {
+		return nil, err
+	}
+	var claims bearerClaims
+	if err := token.Claims(b.secret, &claims); err != nil {
+		return nil, err
+	}
+	err = claims.ValidateWithLeeway(jwt.Expected{AnyAudience: jwt.Audience{b.audience}, Time: globals.Clock.Now()}, 0)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Expiry == nil || claims.Subject == "" {
+		return nil, errors.New("token has no expiry or subject")
+	}
+	return &state.Identity{User: claims.Subject, Email: claims.Email, Name: claims.Name, Groups: claims.Groups}, nil
+}
+
+// bearerCredential returns the credential in r's Authorization header, if it
+// uses the Bearer scheme.
+func bearerCredential(r *http.Request) (string, bool) {
+	scheme, credential, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(credential), true
+}
+
+// Middleware returns a middleware that authenticates requests carrying a
+// bearer credential, which is removed before the request is passed on.  The
+// user's session (see state.WithIdentity) is then used in place of the
+// session cookie.  Requests with an invalid credential get a 401.  A nil
+// BearerAuth passes every request on unchanged.
+func (b *BearerAuth) Middleware(next http.Handler) http.Handler {
+	if b == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credential, ok := bearerCredential(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, err := b.Identify(credential)
+		if err != nil {
+			loginFailed(r, reasonInvalidCredential, err, "", absoluteURL(r))
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, ErrUnauthorized.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		r = state.WithIdentity(r, id)
+		r.Header.Del("Authorization")
+		next.ServeHTTP(w, r)
+	})
+}
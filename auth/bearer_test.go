@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	realclock "code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/clock/fakeclock"
+	"github.com/davars/sohop/globals"
+	"github.com/davars/sohop/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTokenSecret = "3c0767ada2466a92a59c1214061441713aeafe6d115e29aa376c0f9758cdf0f5"
+
+func TestBearerAuth(t *testing.T) {
+	clock := fakeclock.NewFakeClock(time.Now())
+	globals.Clock = clock
+	defer func() { globals.Clock = realclock.NewClock() }()
+
+	key, hash, err := NewAPIKey()
+	require.NoError(t, err)
+	b, err := NewBearerAuth([]APIKey{{Hash: hash, User: "deploy", Groups: []string{"ci"}}}, testTokenSecret, "example.com")
+	require.NoError(t, err)
+
+	id, err := b.Identify(key)
+	require.NoError(t, err)
+	assert.Equal(t, &state.Identity{User: "deploy", Groups: []string{"ci"}}, id)
+
+	_, err = b.Identify(hash)
+	assert.EqualError(t, err, "unknown API key")
+
+	token, err := b.Mint(&state.Identity{User: "octocat", Email: "octocat@example.com", Groups: []string{"staff"}}, time.Hour)
+	require.NoError(t, err)
+	id, err = b.Identify(token)
+	require.NoError(t, err)
+	assert.Equal(t, &state.Identity{User: "octocat", Email: "octocat@example.com", Groups: []string{"staff"}}, id)
+
+	// Tokens are only accepted by the audience they were minted for.
+	other, err := NewBearerAuth(nil, testTokenSecret, "example.org")
+	require.NoError(t, err)
+	_, err = other.Identify(token)
+	assert.Error(t, err)
+
+	clock.Increment(2 * time.Hour)
+	_, err = b.Identify(token)
+	assert.Error(t, err)
+
+	keysOnly, err := NewBearerAuth(nil, "", "example.com")
+	require.NoError(t, err)
+	_, err = keysOnly.Mint(id, time.Hour)
+	assert.Error(t, err)
+
+	_, err = NewBearerAuth([]APIKey{{Hash: "hunter2", User: "deploy"}}, "", "example.com")
+	assert.EqualError(t, err, "API key 0: hash should be a 64-character hex-encoded SHA-256 hash")
+	_, err = NewBearerAuth(nil, "hunter2", "example.com")
+	assert.Error(t, err)
+}
+
+func TestBearerAuth_Middleware(t *testing.T) {
+	key, hash, err := NewAPIKey()
+	require.NoError(t, err)
+	b, err := NewBearerAuth([]APIKey{{Hash: hash, User: "deploy"}}, "", "example.com")
+	require.NoError(t, err)
+
+	store, err := state.New("test", testTokenSecret, "example.com")
+	require.NoError(t, err)
+	handler := b.Middleware(Middleware(newMockAuther(""), store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Authorization"))
+		w.Write([]byte(store.GetSession(r).User))
+	})))
+
+	tests := map[string]struct {
+		header http.Header
+		status int
+		body   string
+	}{
+		"api key": {
+			header: http.Header{"Authorization": {"Bearer " + key}},
+			status: http.StatusOK,
+			body:   "deploy",
+		},
+		"invalid key": {
+			header: http.Header{"Authorization": {"Bearer " + hash}},
+			status: http.StatusUnauthorized,
+		},
+		"browser": {
+			header: http.Header{"Accept": {"text/html,application/xhtml+xml,*/*;q=0.8"}},
+			status: http.StatusFound,
+		},
+		"script": {
+			header: http.Header{"Accept": {"*/*"}},
+			status: http.StatusUnauthorized,
+		},
+		"basic auth": {
+			header: http.Header{"Authorization": {"Basic ZGVwbG95Og=="}},
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "https://foo.example.com/", nil)
+			for k, v := range test.header {
+				req.Header[k] = v
+			}
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			assert.Equal(t, test.status, rw.Code)
+			if test.status == http.StatusOK {
+				assert.Equal(t, test.body, rw.Body.String())
+				assert.Empty(t, rw.Result().Cookies())
+			}
+			if test.status == http.StatusUnauthorized {
+				assert.Contains(t, rw.Header().Get("WWW-Authenticate"), "Bearer")
+			}
+		})
+	}
+}
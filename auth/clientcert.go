@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/davars/sohop/globals"
+	"github.com/davars/sohop/state"
+)
+
+// The certificate fields a CertAuth can take the user from.
+const (
+	CertUserCN    = "cn"
+	CertUserEmail = "email"
+)
+
+// A CertAuth authenticates requests with the TLS client certificate verified
+// during the handshake, for devices and services that can't log in
+// interactively.
+type CertAuth struct {
+	user string
+}
+
+// NewCertAuth returns a CertAuth that takes the user from the given field of
+// the certificate: CertUserCN (the default if user is "") or CertUserEmail.
+func NewCertAuth(user string) (*CertAuth, error) {
+	switch user {
+	case "":
+		user = CertUserCN
+	case CertUserCN, CertUserEmail:
+	default:
+		return nil, fmt.Errorf("unknown client certificate field %q", user)
+	}
+	return &CertAuth{user: user}, nil
+}
+
+// Identify returns the identity of the certificate's subject.  The name is
+// the subject's common name, the email is its first email address SAN, and
+// the groups are its organizational units.
+func (c *CertAuth) Identify(cert *x509.Certificate) (*state.Identity, error) {
+	id := &state.Identity{
+		Name:   cert.Subject.CommonName,
+		Groups: cert.Subject.OrganizationalUnit,
+	}
+	if len(cert.EmailAddresses) > 0 {
+		id.Email = cert.EmailAddresses[0]
+	}
+	switch c.user {
+	case CertUserEmail:
+		id.User = id.Email
+	default:
+		id.User = id.Name
+	}
+	if id.User == "" {
+		return nil, errors.New("certificate has no " + c.user)
+	}
+	return id, nil
+}
+
+// Middleware returns a middleware that authenticates requests made with a
+// verified client certificate.  The user's session (see state.WithIdentity)
+// is then used in place of the session cookie.  Other requests, including
+// those whose certificate doesn't identify a user, are passed on unchanged,
+// so the user can log in as usual.  A nil CertAuth passes every request on
+// unchanged.
+func (c *CertAuth) Middleware(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Certificates are only verified if the server was configured with
+		// the CAs to verify them against.
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, err := c.Identify(r.TLS.VerifiedChains[0][0])
+		if err != nil {
+			globals.Logger(r.Context()).Warn("client certificate ignored", "subject", r.TLS.VerifiedChains[0][0].Subject.String(), "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, state.WithIdentity(r, id))
+	})
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/davars/sohop/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertAuth(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "sensor-1", OrganizationalUnit: []string{"devices"}},
+		EmailAddresses: []string{"sensor-1@example.com"},
+	}
+
+	c, err := NewCertAuth("")
+	require.NoError(t, err)
+	id, err := c.Identify(cert)
+	require.NoError(t, err)
+	assert.Equal(t, &state.Identity{User: "sensor-1", Email: "sensor-1@example.com", Name: "sensor-1", Groups: []string{"devices"}}, id)
+
+	c, err = NewCertAuth(CertUserEmail)
+	require.NoError(t, err)
+	id, err = c.Identify(cert)
+	require.NoError(t, err)
+	assert.Equal(t, "sensor-1@example.com", id.User)
+
+	_, err = c.Identify(&x509.Certificate{Subject: pkix.Name{CommonName: "sensor-2"}})
+	assert.EqualError(t, err, "certificate has no email")
+
+	_, err = NewCertAuth("serial")
+	assert.EqualError(t, err, `unknown client certificate field "serial"`)
+}
+
+func TestCertAuth_Middleware(t *testing.T) {
+	c, err := NewCertAuth(CertUserCN)
+	require.NoError(t, err)
+
+	store, err := state.New("test", testTokenSecret, "example.com")
+	require.NoError(t, err)
+	handler := c.Middleware(Middleware(newMockAuther(""), store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(store.GetSession(r).User))
+	})))
+
+	tests := map[string]struct {
+		tls    *tls.ConnectionState
+		status int
+		body   string
+	}{
+		"verified": {
+			tls: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+				{Subject: pkix.Name{CommonName: "sensor-1"}},
+			}}},
+			status: http.StatusOK,
+			body:   "sensor-1",
+		},
+		"unverified": {
+			tls: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+				{Subject: pkix.Name{CommonName: "sensor-1"}},
+			}},
+			status: http.StatusFound,
+		},
+		"no user": {
+			tls:    &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}},
+			status: http.StatusFound,
+		},
+		"no certificate": {
+			tls:    &tls.ConnectionState{},
+			status: http.StatusFound,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "https://foo.example.com/", nil)
+			req.TLS = test.tls
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			assert.Equal(t, test.status, rw.Code)
+			if test.status == http.StatusOK {
+				assert.Equal(t, test.body, rw.Body.String())
+			}
+		})
+	}
+}
@@ -1,8 +1,15 @@
 package auth
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log/slog"
 	"net/http"
+	"strings"
 
+	"github.com/davars/sohop/audit"
+	"github.com/davars/sohop/globals"
 	"github.com/davars/sohop/state"
 	"golang.org/x/oauth2"
 )
@@ -12,46 +19,136 @@ type oauthFLow struct {
 	state state.Store
 }
 
+// errNoEndpoint is returned when the Auther can't provide a login URL (for
+// example when OpenID Connect discovery fails).
+var errNoEndpoint = errors.New("auth provider unavailable")
+
+// nonce derives the nonce for a flow from its state key.  The state key is
+// bound to the browser that started the flow by the state cookie, so the
+// nonce is too.
+func nonce(stateKey string) string {
+	h := sha256.Sum256([]byte(stateKey))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// loginFailed records a failed attempt to log in to redirectURL.  user is ""
+// unless the provider identified the user.
+func loginFailed(r *http.Request, reason string, err error, user, redirectURL string) {
+	authAttempts.WithLabelValues("failure", reason).Inc()
+	level := slog.LevelWarn
+	if reason == reasonUnavailable || reason == reasonSession {
+		level = slog.LevelError
+	}
+	globals.Logger(r.Context()).Log(r.Context(), level, "login failed", "reason", reason, "user", user, "error", err)
+	audit.Record(r, audit.Event{
+		Event:  audit.LoginFailed,
+		Reason: reason,
+		Error:  err.Error(),
+		User:   user,
+		URL:    redirectURL,
+	})
+}
+
 func (s *oauthFLow) redirectToLogin(w http.ResponseWriter, r *http.Request) bool {
 	if s.state.IsAuthorized(r) {
 		return false
 	}
 
-	state, err := s.state.CreateState(w, absoluteURL(r))
-	if checkServerError(err, w) {
+	if !fromBrowser(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, ErrUnauthorized.Error(), http.StatusUnauthorized)
 		return true
 	}
-
-	url := s.auth.OAuthConfig().AuthCodeURL(state, oauth2.AccessTypeOffline)
-	http.Redirect(w, r, url, http.StatusFound)
+	s.startLogin(w, r, absoluteURL(r))
 	return true
 }
 
-func (s *oauthFLow) authenticateCode(w http.ResponseWriter, r *http.Request) {
-	redirectURL, err := s.state.RedeemState(w, r, r.URL.Query().Get("state"))
+// fromBrowser guesses whether r was made by a browser, which can be sent to
+// log in, rather than a script or API client, which can't.  Requests that
+// carry credentials, are made by scripts in the page, or don't accept HTML are
+// assumed not to be.
+func fromBrowser(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" || r.Header.Get("X-Requested-With") != "" {
+		return false
+	}
+	accept := r.Header.Get("Accept")
+	return accept == "" || strings.Contains(accept, "text/html")
+}
+
+// startLogin redirects the user to the Auther's login URL.  Once they've
+// logged in they're redirected to redirectURL.
+func (s *oauthFLow) startLogin(w http.ResponseWriter, r *http.Request, redirectURL string) {
+	oauthConfig := s.auth.OAuthConfig()
+	if oauthConfig.Endpoint.AuthURL == "" {
+		loginFailed(r, reasonUnavailable, errNoEndpoint, "", redirectURL)
+		checkServerError(errNoEndpoint, w)
+		return
+	}
+
+	state, err := s.state.CreateState(w, redirectURL)
 	if checkServerError(err, w) {
 		return
 	}
 
-	if s.state.IsAuthorized(r) {
-		http.Redirect(w, r, redirectURL, http.StatusFound)
+	opts := []oauth2.AuthCodeOption{oauth2.AccessTypeOffline}
+	if _, ok := s.auth.(NonceAuther); ok {
+		opts = append(opts, oauth2.SetAuthURLParam("nonce", nonce(state)))
+	}
+	if ao, ok := s.auth.(AuthCodeOptioner); ok {
+		opts = append(opts, ao.AuthCodeOptions()...)
+	}
+
+	url := oauthConfig.AuthCodeURL(state, opts...)
+	globals.Logger(r.Context()).Debug("login started", "redirect", redirectURL)
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+func (s *oauthFLow) authenticateCode(w http.ResponseWriter, r *http.Request) {
+	stateKey := r.URL.Query().Get("state")
+	redirectURL, err := s.state.RedeemState(w, r, stateKey)
+	if err != nil {
+		loginFailed(r, reasonInvalidState, err, "", "")
+		checkServerError(err, w)
 		return
 	}
 
+	// Users who are already logged in are authenticated again if the provider
+	// sent a code, since they may have been asked to log in again (see
+	// state.WithMaxAge).
 	code := r.URL.Query().Get("code")
+	if code == "" && s.state.IsAuthorized(r) {
+		http.Redirect(w, r, redirectURL, http.StatusFound)
+		return
+	}
 	if code == "" {
+		loginFailed(r, reasonMissingCode, ErrMissingCode, "", redirectURL)
 		http.Error(w, ErrMissingCode.Error(), http.StatusBadRequest)
 		return
 	}
 
-	user, err := s.auth.Auth(code)
+	var id *state.Identity
+	if na, ok := s.auth.(NonceAuther); ok {
+		id, err = na.AuthNonce(code, nonce(stateKey))
+	} else {
+		id, err = s.auth.Auth(code)
+	}
 	if err != nil {
+		var denied *DeniedError
+		if errors.As(err, &denied) {
+			loginFailed(r, reasonDenied, err, denied.User, redirectURL)
+		} else {
+			loginFailed(r, reasonProviderError, err, "", redirectURL)
+		}
 		http.Error(w, ErrUnauthorized.Error(), http.StatusUnauthorized)
 		return
 	}
-	if err := s.state.Authorize(w, r, user); err != nil {
+	if err := s.state.Authorize(w, r, id); err != nil {
+		loginFailed(r, reasonSession, err, id.User, redirectURL)
 		http.Error(w, ErrUnauthorized.Error(), http.StatusInternalServerError)
 		return
 	}
+	authAttempts.WithLabelValues("success", "").Inc()
+	globals.Logger(r.Context()).Info("login succeeded", "user", id.User)
+	audit.Record(r, audit.Event{Event: audit.Login, User: id.User, URL: redirectURL})
 	http.Redirect(w, r, redirectURL, http.StatusFound)
 }
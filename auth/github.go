@@ -4,8 +4,11 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/davars/sohop/state"
 	"github.com/google/go-github/github"
 	"golang.org/x/oauth2"
 	githubauth "golang.org/x/oauth2/github"
@@ -15,8 +18,9 @@ func init() {
 	registeredAuthers["github-org"] = reflect.TypeOf(GithubAuth{})
 }
 
-// GithubAuth implements the Github OrgID middleware.  Users must be logged into
-// Github and be a member of the specified Org to be authorized.
+// GithubAuth implements the Github middleware.  Users must be logged into
+// Github and be listed in Users, or be a member of the specified org (or of
+// one of the specified teams within it) to be authorized.
 //
 // To use, you'll need to create an application to use the Github API for
 // authentication.  Read https://developer.github.com/guides/basics-of-authentication/
@@ -28,6 +32,18 @@ type GithubAuth struct {
 	// OrgID is the ID of the org whose members are authorized. Run
 	// `curl https://api.github.com/orgs/:org` to get the id.
 	OrgID int64
+
+	// Org is the login name of the org whose members are authorized.  It may
+	// be used instead of OrgID.
+	Org string
+
+	// Teams restricts access to members of the listed teams (identified by
+	// their slug) within Org, rather than all of Org's members.
+	Teams []string
+
+	// Users are the logins of Github users that are authorized regardless of
+	// their org or team memberships.
+	Users []string
 }
 
 // OAuthConfig is implemented so GithubAuth satisfies the Auther interface.
@@ -40,33 +56,144 @@ func (ga GithubAuth) OAuthConfig() *oauth2.Config {
 	}
 }
 
-// Auth is implemented so GithubAuth satisfies the Auther interface.
-func (ga GithubAuth) Auth(code string) (string, error) {
+// Auth is implemented so GithubAuth satisfies the Auther interface.  The
+// identity's groups are the user's orgs and their teams (as "org/team-slug").
+func (ga GithubAuth) Auth(code string) (*state.Identity, error) {
 	oauthConfig := ga.OAuthConfig()
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
 	tok, err := oauthConfig.Exchange(ctx, code)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	client := github.NewClient(oauthConfig.Client(ctx, tok))
-	user, _, err := client.Users.Get(ctx, "")
+	return ga.authorize(ctx, github.NewClient(oauthConfig.Client(ctx, tok)))
+}
+
+// authorize returns the identity of the user client acts on behalf of if they
+// satisfy one of the configured rules.  Otherwise the error describes each
+// rule the user failed.
+func (ga GithubAuth) authorize(ctx context.Context, client *github.Client) (*state.Identity, error) {
+	id, orgs, teams, err := ga.identity(ctx, client)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	var failed []string
+
+	if len(ga.Users) > 0 {
+		for _, u := range ga.Users {
+			if strings.EqualFold(u, id.User) {
+				return id, nil
+			}
+		}
+		failed = append(failed, "is not in the list of allowed users")
+	}
+
+	if len(ga.Teams) > 0 {
+		if ga.Org == "" {
+			return nil, fmt.Errorf("Teams requires Org to be set")
+		}
+		if teams == nil {
+			return nil, fmt.Errorf("could not list teams for github user %q", id.User)
+		}
+		for _, team := range teams {
+			if !strings.EqualFold(team.GetOrganization().GetLogin(), ga.Org) {
+				continue
+			}
+			for _, slug := range ga.Teams {
+				if strings.EqualFold(team.GetSlug(), slug) {
+					return id, nil
+				}
+			}
+		}
+		failed = append(failed, fmt.Sprintf("is not a member of teams %s in org %q", strings.Join(ga.Teams, ", "), ga.Org))
+	} else if ga.Org != "" || ga.OrgID != 0 {
+		for _, org := range orgs {
+			if ga.OrgID != 0 && org.GetID() == ga.OrgID {
+				return id, nil
+			}
+			if ga.Org != "" && strings.EqualFold(org.GetLogin(), ga.Org) {
+				return id, nil
+			}
+		}
+		if ga.Org != "" {
+			failed = append(failed, fmt.Sprintf("is not a member of org %q", ga.Org))
+		} else {
+			failed = append(failed, fmt.Sprintf("is not a member of org %d", ga.OrgID))
+		}
 	}
 
-	orgs, _, err := client.Organizations.List(ctx, "", nil)
+	if len(failed) == 0 {
+		return nil, fmt.Errorf("no Org, OrgID, Teams or Users configured")
+	}
+	return nil, &DeniedError{User: id.User, Reason: fmt.Sprintf("github user %q %s", id.User, strings.Join(failed, ", and "))}
+}
+
+// identity looks up the user client acts on behalf of, along with their orgs
+// and teams.  teams is nil if they couldn't be listed (e.g. because an org
+// restricts third-party access).
+func (ga GithubAuth) identity(ctx context.Context, client *github.Client) (id *state.Identity, orgs []*github.Organization, teams []*github.Team, err error) {
+	user, _, err := client.Users.Get(ctx, "")
 	if err != nil {
-		return "", err
+		return nil, nil, nil, err
 	}
 
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := client.Organizations.List(ctx, "", opt)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		orgs = append(orgs, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	opt = &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := client.Teams.ListUserTeams(ctx, opt)
+		if err != nil {
+			teams = nil
+			break
+		}
+		if teams == nil {
+			teams = []*github.Team{}
+		}
+		teams = append(teams, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	id = &state.Identity{
+		User:   user.GetLogin(),
+		Name:   user.GetName(),
+		Email:  user.GetEmail(),
+		Claims: map[string]string{"id": strconv.FormatInt(user.GetID(), 10)},
+	}
 	for _, org := range orgs {
-		if *org.ID == ga.OrgID {
-			return *user.Login, nil
+		id.Groups = append(id.Groups, org.GetLogin())
+	}
+	for _, team := range teams {
+		id.Groups = append(id.Groups, team.GetOrganization().GetLogin()+"/"+team.GetSlug())
+	}
+
+	if id.Email == "" {
+		// The user's public email is unset; use their primary address instead.
+		emails, _, err := client.Users.ListEmails(ctx, nil)
+		if err == nil {
+			for _, email := range emails {
+				if email.GetPrimary() && email.GetVerified() {
+					id.Email = email.GetEmail()
+				}
+			}
 		}
 	}
 
-	return "", fmt.Errorf("unauthorized")
+	return id, orgs, teams, nil
 }
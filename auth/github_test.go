@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/davars/sohop/state"
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestGithub returns a client for a stand-in Github API where the current
+// user is "octocat", a member of org "acme" (ID 42) and its team "ops".
+func newTestGithub(t *testing.T) (*github.Client, func()) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"login": "octocat", "id": 583231, "name": "The Octocat"}`)
+	})
+	mux.HandleFunc("/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"email": "old@example.com", "verified": true}, {"email": "octocat@example.com", "verified": true, "primary": true}]`)
+	})
+	mux.HandleFunc("/user/orgs", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"id": 42, "login": "acme"}]`)
+	})
+	mux.HandleFunc("/user/teams", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"slug": "ops", "organization": {"login": "acme"}}, {"slug": "admins", "organization": {"login": "other"}}]`)
+	})
+	server := httptest.NewServer(mux)
+
+	client := github.NewClient(nil)
+	baseURL, err := url.Parse(server.URL + "/")
+	require.NoError(t, err)
+	client.BaseURL = baseURL
+	return client, server.Close
+}
+
+func TestGithubAuth_authorize(t *testing.T) {
+	client, done := newTestGithub(t)
+	defer done()
+
+	tests := map[string]struct {
+		auther GithubAuth
+		err    string
+	}{
+		"org id": {
+			auther: GithubAuth{OrgID: 42},
+		},
+		"org": {
+			auther: GithubAuth{Org: "ACME"},
+		},
+		"team": {
+			auther: GithubAuth{Org: "acme", Teams: []string{"devs", "ops"}},
+		},
+		"user": {
+			auther: GithubAuth{Org: "other", Users: []string{"octocat"}},
+		},
+		"wrong org id": {
+			auther: GithubAuth{OrgID: 43},
+			err:    `github user "octocat" is not a member of org 43`,
+		},
+		"wrong org": {
+			auther: GithubAuth{Org: "other"},
+			err:    `github user "octocat" is not a member of org "other"`,
+		},
+		"wrong team": {
+			auther: GithubAuth{Org: "acme", Teams: []string{"devs"}},
+			err:    `github user "octocat" is not a member of teams devs in org "acme"`,
+		},
+		"team in other org": {
+			auther: GithubAuth{Org: "acme", Teams: []string{"admins"}},
+			err:    `github user "octocat" is not a member of teams admins in org "acme"`,
+		},
+		"wrong user and org": {
+			auther: GithubAuth{Org: "other", Users: []string{"hubot"}},
+			err:    `github user "octocat" is not in the list of allowed users, and is not a member of org "other"`,
+		},
+		"teams without org": {
+			auther: GithubAuth{Teams: []string{"ops"}},
+			err:    "Teams requires Org to be set",
+		},
+		"no rules": {
+			err: "no Org, OrgID, Teams or Users configured",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			id, err := test.auther.authorize(context.Background(), client)
+			if test.err == "" {
+				require.NoError(t, err)
+				assert.Equal(t, &state.Identity{
+					User:   "octocat",
+					Name:   "The Octocat",
+					Email:  "octocat@example.com",
+					Groups: []string{"acme", "acme/ops", "other/admins"},
+					Claims: map[string]string{"id": "583231"},
+				}, id)
+			} else {
+				require.Error(t, err)
+				assert.Equal(t, test.err, err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/davars/sohop/state"
+	"golang.org/x/oauth2"
+)
+
+func init() {
+	registeredAuthers["google-domain"] = reflect.TypeOf(GoogleAuth{})
+}
+
+const googleIssuer = "https://accounts.google.com"
+
+// GoogleAuth implements the Google Workspace middleware.  Users must sign in
+// with a Google Workspace account belonging to one of the configured Domains
+// to be authorized.  The user is identified by their (verified) email address,
+// and the "hd" claim is available in the session's claims.
+//
+// To use, create an OAuth client ID of type "Web application" in the Google
+// Cloud console with https://oauth.<Domain>/authorized as an authorized
+// redirect URI.
+type GoogleAuth struct {
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is the URL Google redirects back to after login.  It should
+	// be https://oauth.<Domain>/authorized.
+	RedirectURL string
+
+	// Domains are the Workspace domains whose users are authorized.  They're
+	// compared with the "hd" (hosted domain) claim of the ID token, which
+	// Google only sets for Workspace accounts.
+	Domains []string
+
+	// issuer overrides googleIssuer in tests.
+	issuer string
+
+	mu   sync.Mutex
+	oidc *OIDCAuth
+}
+
+// oidcAuth returns the OpenID Connect auther used to talk to Google.
+func (ga *GoogleAuth) oidcAuth() *OIDCAuth {
+	ga.mu.Lock()
+	defer ga.mu.Unlock()
+
+	if ga.oidc == nil {
+		issuer := ga.issuer
+		if issuer == "" {
+			issuer = googleIssuer
+		}
+		ga.oidc = &OIDCAuth{
+			Issuer:       issuer,
+			ClientID:     ga.ClientID,
+			ClientSecret: ga.ClientSecret,
+			RedirectURL:  ga.RedirectURL,
+			UserClaim:    "email",
+			Claims:       []string{"hd"},
+		}
+	}
+	return ga.oidc
+}
+
+// OAuthConfig is implemented so GoogleAuth satisfies the Auther interface.
+func (ga *GoogleAuth) OAuthConfig() *oauth2.Config {
+	return ga.oidcAuth().OAuthConfig()
+}
+
+// AuthCodeOptions is implemented so GoogleAuth satisfies the AuthCodeOptioner
+// interface.  With a single domain, it hints Google's account chooser; the
+// claim is still verified in Auth.
+func (ga *GoogleAuth) AuthCodeOptions() []oauth2.AuthCodeOption {
+	if len(ga.Domains) != 1 {
+		return nil
+	}
+	return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("hd", ga.Domains[0])}
+}
+
+// Auth is implemented so GoogleAuth satisfies the Auther interface.
+func (ga *GoogleAuth) Auth(code string) (*state.Identity, error) {
+	return ga.AuthNonce(code, "")
+}
+
+// AuthNonce is implemented so GoogleAuth satisfies the NonceAuther interface.
+func (ga *GoogleAuth) AuthNonce(code, nonce string) (*state.Identity, error) {
+	oa := ga.oidcAuth()
+	claims, err := oa.verify(code, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if err := ga.authorize(claims); err != nil {
+		return nil, err
+	}
+	return oa.identity(claims), nil
+}
+
+// authorize returns nil if the claims show a verified email address in one
+// of the allowed hosted domains.
+func (ga *GoogleAuth) authorize(claims map[string]interface{}) error {
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return fmt.Errorf("id_token has no email claim")
+	}
+	if verified, _ := claims["email_verified"].(bool); !verified {
+		return &DeniedError{User: email, Reason: fmt.Sprintf("email %q is not verified", email)}
+	}
+
+	hd, _ := claims["hd"].(string)
+	if hd == "" {
+		return &DeniedError{User: email, Reason: fmt.Sprintf("%q is not a Google Workspace account", email)}
+	}
+	for _, domain := range ga.Domains {
+		if strings.EqualFold(hd, domain) {
+			return nil
+		}
+	}
+	return &DeniedError{User: email, Reason: fmt.Sprintf("%q belongs to domain %q, which is not allowed", email, hd)}
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/davars/sohop/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoogleAuth_authorize(t *testing.T) {
+	tests := map[string]struct {
+		claims map[string]interface{}
+		err    string
+	}{
+		"allowed": {
+			claims: map[string]interface{}{"email": "user@example.com", "email_verified": true, "hd": "example.com"},
+		},
+		"allowed case-insensitive": {
+			claims: map[string]interface{}{"email": "user@example.org", "email_verified": true, "hd": "Example.ORG"},
+		},
+		"no email": {
+			claims: map[string]interface{}{"hd": "example.com"},
+			err:    "id_token has no email claim",
+		},
+		"unverified": {
+			claims: map[string]interface{}{"email": "user@example.com", "email_verified": false, "hd": "example.com"},
+			err:    `email "user@example.com" is not verified`,
+		},
+		"consumer account": {
+			claims: map[string]interface{}{"email": "user@example.com", "email_verified": true},
+			err:    `"user@example.com" is not a Google Workspace account`,
+		},
+		"other domain": {
+			claims: map[string]interface{}{"email": "user@other.com", "email_verified": true, "hd": "other.com"},
+			err:    `"user@other.com" belongs to domain "other.com", which is not allowed`,
+		},
+	}
+
+	ga := &GoogleAuth{Domains: []string{"example.com", "example.org"}}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := ga.authorize(test.claims)
+			if test.err == "" {
+				assert.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Equal(t, test.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestGoogleAuth(t *testing.T) {
+	ti := newTestIssuer(t)
+	defer ti.Close()
+
+	ti.claims = map[string]interface{}{
+		"iss":            ti.URL,
+		"aud":            "id",
+		"sub":            "1234",
+		"email":          "user@example.com",
+		"email_verified": true,
+		"hd":             "example.com",
+		"nonce":          "n0nce",
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	}
+
+	ga := &GoogleAuth{ClientID: "id", ClientSecret: "secret", Domains: []string{"example.com"}, issuer: ti.URL}
+	assert.Equal(t, ti.URL+"/auth", ga.OAuthConfig().Endpoint.AuthURL)
+	authURL, err := url.Parse(ga.OAuthConfig().AuthCodeURL("state", ga.AuthCodeOptions()...))
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", authURL.Query().Get("hd"))
+
+	id, err := ga.AuthNonce("code", "n0nce")
+	require.NoError(t, err)
+	assert.Equal(t, &state.Identity{
+		User:   "user@example.com",
+		Email:  "user@example.com",
+		Claims: map[string]string{"hd": "example.com"},
+	}, id)
+}
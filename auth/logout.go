@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/davars/sohop/audit"
+	"github.com/davars/sohop/globals"
+	"github.com/davars/sohop/state"
+)
+
+// A Logouter is an Auther whose provider can also end the user's session with
+// the provider.  LogoutURL returns the URL to send the user to, which will
+// eventually redirect them to returnTo (if not empty).  It returns "" if the
+// provider's session can't be ended.
+type Logouter interface {
+	Auther
+	LogoutURL(returnTo string) string
+}
+
+var logoutTemplate = template.Must(template.New("logout").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign out</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; background: #f6f8fa; color: #24292e; margin: 0; }
+main { max-width: 32em; margin: 15vh auto; padding: 2em; background: #fff; border: 1px solid #e1e4e8; border-radius: 6px; }
+h1 { font-size: 1.5em; margin-top: 0; }
+</style>
+</head>
+<body>
+<main>
+<h1>Sign out</h1>
+<form method="post">
+<button type="submit">Sign out</button>
+</form>
+</main>
+</body>
+</html>
+`))
+
+// LogoutHandler returns an http.Handler that clears the user's session.  The
+// user is then redirected to the URL in the "rd" query parameter, as long as
+// it belongs to domain or one of its subdomains.  If auth is a Logouter, the
+// user visits the provider's logout URL on the way.
+//
+// Only POST requests from pages within domain log the user out, so other sites
+// can't do it with a link or an image.  A GET shows a page that asks the user
+// to confirm.
+func LogoutHandler(auth Auther, state state.Store, domain string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := globals.Logger(r.Context())
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			logoutTemplate.Execute(w, nil)
+			return
+		case http.MethodPost:
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if crossSite(r, domain) {
+			logger.Warn("logout: refusing cross-site request", "origin", r.Header.Get("Origin"))
+			http.Error(w, "cross-site logout refused", http.StatusForbidden)
+			return
+		}
+
+		user := state.GetSession(r).User
+		if checkServerError(state.Logout(w, r), w) {
+			return
+		}
+		logger.Info("logout", "user", user)
+		audit.Record(r, audit.Event{Event: audit.Logout, User: user})
+
+		returnTo := r.URL.Query().Get("rd")
+		if returnTo != "" && !inDomain(returnTo, domain) {
+			logger.Warn("logout: ignoring redirect outside of the domain", "redirect", returnTo, "domain", domain)
+			returnTo = ""
+		}
+
+		if l, ok := auth.(Logouter); ok {
+			if u := l.LogoutURL(returnTo); u != "" {
+				http.Redirect(w, r, u, http.StatusFound)
+				return
+			}
+		}
+
+		if returnTo != "" {
+			http.Redirect(w, r, returnTo, http.StatusFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, "You have been signed out.\n")
+	})
+}
+
+// crossSite returns true if r was sent by a page outside domain, according to
+// the Sec-Fetch-Site and Origin headers that browsers send with POST requests.
+// Requests without either header, e.g. from scripts, are allowed.
+func crossSite(r *http.Request, domain string) bool {
+	if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		return true
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return !inDomain(origin, domain)
+	}
+	return false
+}
+
+// inDomain returns true if rawURL is an absolute http(s) URL whose host is
+// domain or one of its subdomains.
+func inDomain(rawURL, domain string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.User != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	domain = strings.ToLower(domain)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/davars/sohop/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogoutHandler(t *testing.T) {
+	tests := map[string]struct {
+		auther   Auther
+		rd       string
+		location string
+	}{
+		"no redirect": {
+			auther: newMockAuther(""),
+		},
+		"redirect": {
+			auther:   newMockAuther(""),
+			rd:       "https://intranet.example.com/home",
+			location: "https://intranet.example.com/home",
+		},
+		"redirect to domain": {
+			auther:   newMockAuther(""),
+			rd:       "https://example.com/",
+			location: "https://example.com/",
+		},
+		"redirect outside domain": {
+			auther: newMockAuther(""),
+			rd:     "https://evil.com/?example.com",
+		},
+		"redirect to lookalike domain": {
+			auther: newMockAuther(""),
+			rd:     "https://notexample.com/",
+		},
+		"relative redirect": {
+			auther: newMockAuther(""),
+			rd:     "//evil.com/",
+		},
+		"provider logout": {
+			auther:   &logoutMockAuth{},
+			rd:       "https://intranet.example.com/",
+			location: "https://mock/logout?rd=https://intranet.example.com/",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ts := newTestStore(t, &state.Session{Authorized: true, User: "user"}, map[string]*state.OAuthState{})
+			req := httptest.NewRequest("POST", "https://oauth.example.com/logout?rd="+url.QueryEscape(test.rd), nil)
+			req.Header.Set("Origin", "https://oauth.example.com")
+			rw := httptest.NewRecorder()
+			LogoutHandler(test.auther, ts, "example.com").ServeHTTP(rw, req)
+			assert.False(t, ts.session.Authorized)
+
+			if test.location == "" {
+				assert.Equal(t, http.StatusOK, rw.Code)
+				assert.Equal(t, "You have been signed out.\n", rw.Body.String())
+			} else {
+				assert.Equal(t, http.StatusFound, rw.Code)
+				assert.Equal(t, test.location, rw.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestLogoutHandler_crossSite(t *testing.T) {
+	tests := map[string]struct {
+		method string
+		header http.Header
+		status int
+		logout bool
+	}{
+		"get": {
+			method: "GET",
+			status: http.StatusOK,
+		},
+		"put": {
+			method: "PUT",
+			status: http.StatusMethodNotAllowed,
+		},
+		"same site": {
+			method: "POST",
+			header: http.Header{"Sec-Fetch-Site": {"same-site"}, "Origin": {"https://intranet.example.com"}},
+			status: http.StatusOK,
+			logout: true,
+		},
+		"no headers": {
+			method: "POST",
+			status: http.StatusOK,
+			logout: true,
+		},
+		"cross site": {
+			method: "POST",
+			header: http.Header{"Sec-Fetch-Site": {"cross-site"}},
+			status: http.StatusForbidden,
+		},
+		"foreign origin": {
+			method: "POST",
+			header: http.Header{"Origin": {"https://evil.com"}},
+			status: http.StatusForbidden,
+		},
+		"null origin": {
+			method: "POST",
+			header: http.Header{"Origin": {"null"}},
+			status: http.StatusForbidden,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ts := newTestStore(t, &state.Session{Authorized: true, User: "user"}, map[string]*state.OAuthState{})
+			req := httptest.NewRequest(test.method, "https://oauth.example.com/logout", nil)
+			for k, v := range test.header {
+				req.Header[k] = v
+			}
+			rw := httptest.NewRecorder()
+			LogoutHandler(newMockAuther(""), ts, "example.com").ServeHTTP(rw, req)
+			assert.Equal(t, test.status, rw.Code)
+			assert.Equal(t, !test.logout, ts.session.Authorized)
+			if test.method == "GET" {
+				assert.Contains(t, rw.Body.String(), `<form method="post">`)
+			}
+		})
+	}
+}
+
+type logoutMockAuth struct {
+	MockAuth
+}
+
+func (la *logoutMockAuth) LogoutURL(returnTo string) string {
+	return "https://mock/logout?rd=" + returnTo
+}
@@ -0,0 +1,25 @@
+package auth
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons a login fails, used to label authAttempts.
+const (
+	reasonUnavailable   = "provider_unavailable"
+	reasonInvalidState  = "invalid_state"
+	reasonMissingCode   = "missing_code"
+	reasonDenied        = "denied"
+	reasonProviderError = "provider_error"
+	reasonSession       = "session_error"
+
+	// reasonInvalidCredential is used for requests with an invalid bearer
+	// credential (see BearerAuth).
+	reasonInvalidCredential = "invalid_credential"
+)
+
+var authAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sohop_auth_attempts_total",
+	Help: "Logins, by result (success or failure) and the reason for failures.",
+}, []string{"result", "reason"})
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"reflect"
 
+	"github.com/davars/sohop/state"
 	"golang.org/x/oauth2"
 )
 
@@ -16,6 +17,9 @@ type MockAuth struct {
 	ClientID     string
 	ClientSecret string
 	User         string
+	Email        string
+	Name         string
+	Groups       []string
 	Err          string
 }
 
@@ -32,9 +36,9 @@ func (ma MockAuth) OAuthConfig() *oauth2.Config {
 }
 
 // Auth is implemented so MockAuth satisfies the Auther interface.
-func (ma MockAuth) Auth(_ string) (string, error) {
+func (ma MockAuth) Auth(_ string) (*state.Identity, error) {
 	if ma.Err != "" {
-		return "", errors.New(ma.Err)
+		return nil, errors.New(ma.Err)
 	}
-	return ma.User, nil
+	return &state.Identity{User: ma.User, Email: ma.Email, Name: ma.Name, Groups: ma.Groups}, nil
 }
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"reflect"
 
+	"github.com/davars/sohop/globals"
 	"github.com/davars/sohop/state"
 
 	"golang.org/x/oauth2"
@@ -16,15 +17,33 @@ import (
 var registeredAuthers = make(map[string]reflect.Type)
 
 // An Auther abstracts an OAuth flow for authenticating and authorizing access
-// to handlers
+// to handlers.  Auth returns the identity of the authorized user, which is
+// stored in their session.
 type Auther interface {
 	OAuthConfig() *oauth2.Config
-	Auth(code string) (string, error)
+	Auth(code string) (*state.Identity, error)
+}
+
+// A NonceAuther is an Auther that binds the authorization response to the
+// request that initiated it with a nonce (as OpenID Connect does for ID
+// tokens).  The same nonce is sent with the authorization request and passed
+// to AuthNonce.
+type NonceAuther interface {
+	Auther
+	AuthNonce(code, nonce string) (*state.Identity, error)
+}
+
+// An AuthCodeOptioner is an Auther that adds parameters to the authorization
+// request, such as hints for the provider's login page.
+type AuthCodeOptioner interface {
+	Auther
+	AuthCodeOptions() []oauth2.AuthCodeOption
 }
 
 // A Config can be used to create a new Auther
 type Config struct {
-	// Type is the type of Auther.  Supported types are: github-org
+	// Type is the type of Auther.  Supported types are: github-org,
+	// google-domain, oidc
 	Type string
 
 	// Config configures the Auther.  The structure of this value varies
@@ -52,6 +71,20 @@ var (
 	ErrUnauthorized = errors.New("Unauthorized.")
 )
 
+// A DeniedError is returned by an Auther when the provider identified the
+// user, but they aren't allowed to log in.
+type DeniedError struct {
+	// User identifies the user, e.g. their Github login or email address.
+	User string
+
+	// Reason describes why the user isn't allowed.
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return e.Reason
+}
+
 // Handler returns an http.Handler that implements whatever authorization steps
 // are defined by the Auther (typically exchanging the OAuth2 code for an access
 // token and using the token to identify the user).
@@ -62,6 +95,22 @@ func Handler(auth Auther, state state.Store) http.Handler {
 	})
 }
 
+// StartHandler returns an http.Handler that sends the user to the Auther's
+// login URL, even if they're already logged in.  Afterwards they're
+// redirected to the URL in the "rd" query parameter, which must belong to
+// domain or one of its subdomains, or else to https://oauth.<domain>/session.
+// It's used to log in to services protected by a forward-auth proxy.
+func StartHandler(auth Auther, state state.Store, domain string) http.Handler {
+	flow := &oauthFLow{auth: auth, state: state}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirectURL := r.URL.Query().Get("rd")
+		if !inDomain(redirectURL, domain) {
+			redirectURL = fmt.Sprintf("https://oauth.%s/session", domain)
+		}
+		flow.startLogin(w, r, redirectURL)
+	})
+}
+
 // Middleware returns a middleware that checks if the requeset has been
 // authorized.  If not, it generates a redirect to the configured Auther login
 // URL.
@@ -72,6 +121,9 @@ func Middleware(auth Auther, state state.Store) func(http.Handler) http.Handler
 			if flow.redirectToLogin(w, r) {
 				return
 			}
+			if err := state.Touch(w, r); err != nil {
+				globals.Logger(r.Context()).Error("renewing session", "error", err)
+			}
 
 			next.ServeHTTP(w, r)
 		})
@@ -80,11 +132,7 @@ func Middleware(auth Auther, state state.Store) func(http.Handler) http.Handler
 
 // absoluteURL reconstructs the absolute URL string for the provided request
 func absoluteURL(r *http.Request) string {
-	proto := "http"
-	if r.TLS != nil {
-		proto = "https"
-	}
-	return fmt.Sprintf("%s://%s%s", proto, r.Host, r.RequestURI)
+	return fmt.Sprintf("%s://%s%s", globals.Scheme(r), r.Host, r.RequestURI)
 }
 
 // checkServerError renders an http.StatusInternalServerError if the provided
@@ -1,15 +1,22 @@
 package auth
 
 import (
+	"bytes"
 	"crypto/md5"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
+	"github.com/davars/sohop/audit"
+	"github.com/davars/sohop/globals"
 	"github.com/davars/sohop/state"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -36,6 +43,20 @@ func TestNewAuther(t *testing.T) {
 			},
 			out: &GithubAuth{ClientID: "id", ClientSecret: "secret", OrgID: 42},
 		},
+		{
+			in: Config{
+				Type:   "oidc",
+				Config: []byte(`{"Issuer": "https://issuer", "ClientID": "id", "ClientSecret": "secret", "AllowedGroups": ["staff"]}`),
+			},
+			out: &OIDCAuth{Issuer: "https://issuer", ClientID: "id", ClientSecret: "secret", AllowedGroups: []string{"staff"}},
+		},
+		{
+			in: Config{
+				Type:   "google-domain",
+				Config: []byte(`{"ClientID": "id", "ClientSecret": "secret", "Domains": ["example.com"]}`),
+			},
+			out: &GoogleAuth{ClientID: "id", ClientSecret: "secret", Domains: []string{"example.com"}},
+		},
 		{
 			in: Config{
 				Type:   "mock",
@@ -108,6 +129,16 @@ func TestMiddleware(t *testing.T) {
 	}
 }
 
+func TestAbsoluteURL(t *testing.T) {
+	req := httptest.NewRequest("GET", "/path?q=1", nil)
+	req.Host = "foo.example.com"
+	assert.Equal(t, "http://foo.example.com/path?q=1", absoluteURL(req))
+
+	// The scheme reported by a trusted proxy.
+	req = req.WithContext(globals.WithScheme(req.Context(), "https"))
+	assert.Equal(t, "https://foo.example.com/path?q=1", absoluteURL(req))
+}
+
 func TestHandler(t *testing.T) {
 	auther := newMockAuther("")
 	redirectURL := "https://some.other/place"
@@ -122,6 +153,70 @@ func TestHandler(t *testing.T) {
 	assert.Equal(t, redirectURL, url.String())
 }
 
+func TestHandler_Records(t *testing.T) {
+	tests := []struct {
+		uri    string
+		auther Auther
+		result string
+		reason string
+		event  audit.Event
+	}{
+		{
+			uri: "/?code=42&state=testing", auther: newMockAuther(""), result: "success",
+			event: audit.Event{Event: audit.Login, User: "user", URL: "https://some.other/place"},
+		},
+		{
+			uri: "/?code=42&state=other", auther: newMockAuther(""), result: "failure", reason: "invalid_state",
+			event: audit.Event{Event: audit.LoginFailed, Reason: "invalid_state", Error: "not found"},
+		},
+		{
+			uri: "/?state=testing", auther: newMockAuther(""), result: "failure", reason: "missing_code",
+			event: audit.Event{Event: audit.LoginFailed, Reason: "missing_code", Error: ErrMissingCode.Error(), URL: "https://some.other/place"},
+		},
+		{
+			uri: "/?code=42&state=testing", auther: newMockAuther("no"), result: "failure", reason: "provider_error",
+			event: audit.Event{Event: audit.LoginFailed, Reason: "provider_error", Error: "no", URL: "https://some.other/place"},
+		},
+		{
+			uri: "/?code=42&state=testing", auther: &deniedMockAuth{}, result: "failure", reason: "denied",
+			event: audit.Event{Event: audit.LoginFailed, Reason: "denied", Error: `"mallory" is not allowed`, User: "mallory", URL: "https://some.other/place"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.result+" "+test.reason, func(t *testing.T) {
+			ts := newTestStore(t, &state.Session{}, map[string]*state.OAuthState{
+				"testing": {RedirectUrl: "https://some.other/place"},
+			})
+			buf := &bytes.Buffer{}
+			log := audit.New(buf)
+			handler := Handler(test.auther, ts)
+
+			counter := authAttempts.WithLabelValues(test.result, test.reason)
+			before := testutil.ToFloat64(counter)
+			callHandler(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handler.ServeHTTP(w, r.WithContext(audit.NewContext(r.Context(), log)))
+			}), test.uri)
+			assert.Equal(t, before+1, testutil.ToFloat64(counter))
+
+			var event audit.Event
+			require.NoError(t, json.Unmarshal(buf.Bytes(), &event))
+			assert.Equal(t, "127.0.0.1", event.IP)
+			assert.Equal(t, "Go-http-client/1.1", event.UserAgent)
+			event.Time, event.IP, event.UserAgent = time.Time{}, "", ""
+			assert.Equal(t, test.event, event)
+		})
+	}
+}
+
+type deniedMockAuth struct {
+	MockAuth
+}
+
+func (da *deniedMockAuth) Auth(code string) (*state.Identity, error) {
+	return nil, &DeniedError{User: "mallory", Reason: `"mallory" is not allowed`}
+}
+
 func newMockAuther(err string) Auther {
 	return &MockAuth{ClientID: "id", ClientSecret: "secret", User: "user", Err: err}
 }
@@ -140,9 +235,19 @@ func (ts *testStore) GetSession(req *http.Request) (session *state.Session) {
 	return ts.session
 }
 
-func (ts *testStore) Authorize(rw http.ResponseWriter, req *http.Request, user string) error {
-	ts.session.Authorized = true
-	ts.session.User = user
+func (ts *testStore) Authorize(rw http.ResponseWriter, req *http.Request, id *state.Identity) error {
+	session := ts.GetSession(req)
+	session.Authorized = true
+	session.User = id.User
+	return nil
+}
+
+func (ts *testStore) Logout(rw http.ResponseWriter, req *http.Request) error {
+	ts.session = &state.Session{}
+	return nil
+}
+
+func (ts *testStore) Touch(rw http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
@@ -203,3 +308,35 @@ func assertRedirectedTo(t *testing.T, resp *http.Response, url string) {
 		t.Errorf("assertRedirectedTo: got %q, want %q", redirectedTo.String(), url)
 	}
 }
+
+func TestStartHandler(t *testing.T) {
+	tests := map[string]struct {
+		rd          string
+		redirectURL string
+	}{
+		"in domain": {
+			rd:          "https://app.example.com/path",
+			redirectURL: "https://app.example.com/path",
+		},
+		"outside domain": {
+			rd:          "https://evil.com/",
+			redirectURL: "https://oauth.example.com/session",
+		},
+		"missing": {
+			redirectURL: "https://oauth.example.com/session",
+		},
+	}
+
+	auther := newMockAuther("")
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ts := newTestStore(t, &state.Session{Authorized: true}, map[string]*state.OAuthState{})
+			resp := callHandler(t, StartHandler(auther, ts, "example.com"), "/start?rd="+url.QueryEscape(test.rd))
+
+			loc, err := resp.Location()
+			require.NoError(t, err)
+			key := loc.Query().Get("state")
+			assert.Equal(t, test.redirectURL, ts.oauthStates[key].RedirectUrl)
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/davars/sohop/globals"
+	"github.com/davars/sohop/state"
+	"golang.org/x/oauth2"
+)
+
+func init() {
+	registeredAuthers["oidc"] = reflect.TypeOf(OIDCAuth{})
+}
+
+// OIDCAuth implements a generic OpenID Connect middleware.  The provider's
+// endpoints and signing keys are discovered from
+// <Issuer>/.well-known/openid-configuration the first time they're needed.
+// Users are authorized if the provider issues them a valid ID token (and, if
+// AllowedGroups is set, the token lists one of the allowed groups).
+//
+// This works with Keycloak, Dex, Authentik and most other OpenID Connect
+// providers.  Register sohop as a confidential client whose redirect URI is
+// https://oauth.<Domain>/authorized.
+type OIDCAuth struct {
+	// Issuer is the issuer URL of the provider, exactly as it appears in the
+	// "iss" claim of its ID tokens.
+	Issuer string
+
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is the URL the provider redirects back to after login.  It
+	// should be https://oauth.<Domain>/authorized.
+	RedirectURL string
+
+	// Scopes requested in addition to "openid".  Defaults to "profile" and
+	// "email".
+	Scopes []string
+
+	// UserClaim is the ID token claim used as the session's user.  Defaults
+	// to "sub".  If it's "email", users whose email_verified claim is false
+	// are denied.
+	UserClaim string
+
+	// GroupsClaim is the ID token claim listing the user's groups.  Defaults
+	// to "groups".
+	GroupsClaim string
+
+	// Claims lists other ID token claims to keep in the session, as
+	// Session.Claims.  The session is kept in a cookie by default, which
+	// browsers limit to about 4KB, so only claims that are needed should be
+	// listed.
+	Claims []string
+
+	// AllowedGroups, if set, restricts access to users that are members of at
+	// least one of the listed groups.
+	AllowedGroups []string
+
+	// EndSession, if set, makes logging out of sohop also end the user's
+	// session with the provider, via its end_session_endpoint.
+	EndSession bool
+
+	mu        sync.Mutex
+	provider  *oidc.Provider
+	discovery *discovery
+}
+
+// A discovery is an attempt to discover the provider.  done is closed once it
+// has finished, after which err and finished are set.
+type discovery struct {
+	done     chan struct{}
+	err      error
+	finished time.Time
+}
+
+const (
+	// oidcTimeout bounds each request made to the provider.
+	oidcTimeout = 30 * time.Second
+
+	// discoveryRetry is how long a failed discovery is remembered, so logins
+	// fail fast rather than each waiting for an unreachable provider.
+	discoveryRetry = 5 * time.Second
+)
+
+// getProvider returns the discovered provider, performing discovery if it
+// hasn't succeeded yet.  Callers wait for a discovery that's already in
+// progress instead of starting another, and a failed one is returned for
+// discoveryRetry without trying again.
+func (oa *OIDCAuth) getProvider() (*oidc.Provider, error) {
+	oa.mu.Lock()
+	if oa.provider != nil {
+		oa.mu.Unlock()
+		return oa.provider, nil
+	}
+	d := oa.discovery
+	if d != nil {
+		select {
+		case <-d.done:
+			if globals.Clock.Since(d.finished) < discoveryRetry {
+				oa.mu.Unlock()
+				return nil, d.err
+			}
+			d = nil
+		default:
+		}
+	}
+	if d != nil {
+		// Wait for the attempt in progress rather than starting another.
+		oa.mu.Unlock()
+		<-d.done
+		return oa.discovered(d)
+	}
+	d = &discovery{done: make(chan struct{})}
+	oa.discovery = d
+	oa.mu.Unlock()
+
+	// The context outlives this call: the provider uses it to refresh the
+	// issuer's signing keys.
+	ctx := oidc.ClientContext(context.Background(), &http.Client{Timeout: oidcTimeout})
+	provider, err := oidc.NewProvider(ctx, oa.Issuer)
+
+	oa.mu.Lock()
+	if err == nil {
+		oa.provider = provider
+	}
+	d.err = err
+	d.finished = globals.Clock.Now()
+	close(d.done)
+	oa.mu.Unlock()
+	return oa.discovered(d)
+}
+
+// discovered returns the outcome of the finished discovery d.
+func (oa *OIDCAuth) discovered(d *discovery) (*oidc.Provider, error) {
+	oa.mu.Lock()
+	defer oa.mu.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	return oa.provider, nil
+}
+
+func (oa *OIDCAuth) oauthConfig(endpoint oauth2.Endpoint) *oauth2.Config {
+	scopes := oa.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"profile", "email"}
+	}
+	return &oauth2.Config{
+		ClientID:     oa.ClientID,
+		ClientSecret: oa.ClientSecret,
+		RedirectURL:  oa.RedirectURL,
+		Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+		Endpoint:     endpoint,
+	}
+}
+
+// OAuthConfig is implemented so OIDCAuth satisfies the Auther interface.  If
+// the provider can't be discovered the returned config has no endpoint.
+func (oa *OIDCAuth) OAuthConfig() *oauth2.Config {
+	provider, err := oa.getProvider()
+	if err != nil {
+		return oa.oauthConfig(oauth2.Endpoint{})
+	}
+	return oa.oauthConfig(provider.Endpoint())
+}
+
+// Auth is implemented so OIDCAuth satisfies the Auther interface.  It only
+// accepts ID tokens that were issued without a nonce; the auth flow uses
+// AuthNonce instead.
+func (oa *OIDCAuth) Auth(code string) (*state.Identity, error) {
+	return oa.AuthNonce(code, "")
+}
+
+// AuthNonce is implemented so OIDCAuth satisfies the NonceAuther interface.
+// It exchanges the code for an ID token and verifies the token's signature,
+// issuer, audience, expiry and nonce.
+func (oa *OIDCAuth) AuthNonce(code, nonce string) (*state.Identity, error) {
+	claims, err := oa.verify(code, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	id := oa.identity(claims)
+	if id.User == "" {
+		return nil, fmt.Errorf("id_token has no %q claim", oa.userClaim())
+	}
+	// Some providers let users set their own email address.
+	if verified, ok := claims["email_verified"].(bool); ok && !verified && oa.userClaim() == "email" {
+		return nil, &DeniedError{User: id.User, Reason: fmt.Sprintf("email %q is not verified", id.User)}
+	}
+
+	if len(oa.AllowedGroups) > 0 && !containsAny(id.Groups, oa.AllowedGroups) {
+		return nil, &DeniedError{User: id.User, Reason: fmt.Sprintf("%q is not a member of any allowed group", id.User)}
+	}
+
+	return id, nil
+}
+
+// verify exchanges code for an ID token, verifies it, and returns its claims.
+func (oa *OIDCAuth) verify(code, nonce string) (map[string]interface{}, error) {
+	provider, err := oa.getProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oidcTimeout)
+	defer cancel()
+
+	tok, err := oa.oauthConfig(provider.Endpoint()).Exchange(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("token response has no id_token")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: oa.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if idToken.Nonce != nonce {
+		return nil, fmt.Errorf("id_token nonce mismatch")
+	}
+
+	claims := map[string]interface{}{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// LogoutURL is implemented so OIDCAuth satisfies the Logouter interface.
+func (oa *OIDCAuth) LogoutURL(returnTo string) string {
+	if !oa.EndSession {
+		return ""
+	}
+	provider, err := oa.getProvider()
+	if err != nil {
+		return ""
+	}
+
+	var claims struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+	if err := provider.Claims(&claims); err != nil || claims.EndSessionEndpoint == "" {
+		return ""
+	}
+	u, err := url.Parse(claims.EndSessionEndpoint)
+	if err != nil {
+		return ""
+	}
+
+	q := u.Query()
+	q.Set("client_id", oa.ClientID)
+	if returnTo != "" {
+		q.Set("post_logout_redirect_uri", returnTo)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (oa *OIDCAuth) userClaim() string {
+	if oa.UserClaim == "" {
+		return "sub"
+	}
+	return oa.UserClaim
+}
+
+func (oa *OIDCAuth) groupsClaim() string {
+	if oa.GroupsClaim == "" {
+		return "groups"
+	}
+	return oa.GroupsClaim
+}
+
+// identity maps ID token claims onto an Identity.  The claims listed in
+// oa.Claims are kept in Claims, JSON-encoded unless they're strings.
+func (oa *OIDCAuth) identity(claims map[string]interface{}) *state.Identity {
+	id := &state.Identity{Groups: oa.groups(claims)}
+	id.User, _ = claims[oa.userClaim()].(string)
+	id.Name, _ = claims["name"].(string)
+	id.Email, _ = claims["email"].(string)
+	if verified, ok := claims["email_verified"].(bool); ok && !verified {
+		id.Email = ""
+	}
+
+	for _, k := range oa.Claims {
+		v, ok := claims[k]
+		if !ok {
+			continue
+		}
+		if id.Claims == nil {
+			id.Claims = map[string]string{}
+		}
+		if s, ok := v.(string); ok {
+			id.Claims[k] = s
+		} else if b, err := json.Marshal(v); err == nil {
+			id.Claims[k] = string(b)
+		}
+	}
+	return id
+}
+
+// groups returns the values of the configured groups claim.
+func (oa *OIDCAuth) groups(claims map[string]interface{}) []string {
+	var groups []string
+	switch v := claims[oa.groupsClaim()].(type) {
+	case string:
+		groups = append(groups, v)
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	return groups
+}
+
+// containsAny returns true if any element of have is in want.
+func containsAny(have, want []string) bool {
+	for _, h := range have {
+		for _, w := range want {
+			if h == w {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,281 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	realclock "code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/clock/fakeclock"
+	"github.com/davars/sohop/globals"
+	"github.com/davars/sohop/state"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testIssuer is a stand-in OpenID Connect provider.  Its token endpoint
+// responds with an ID token built from claims, signed by signer.
+type testIssuer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	signer *rsa.PrivateKey
+	claims map[string]interface{}
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ti := &testIssuer{key: key, signer: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                ti.URL,
+			"authorization_endpoint":                ti.URL + "/auth",
+			"token_endpoint":                        ti.URL + "/token",
+			"jwks_uri":                              ti.URL + "/keys",
+			"end_session_endpoint":                  ti.URL + "/logout",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: ti.key.Public(), KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: ti.signer},
+			(&jose.SignerOptions{}).WithHeader("kid", "test"))
+		require.NoError(t, err)
+		payload, err := json.Marshal(ti.claims)
+		require.NoError(t, err)
+		jws, err := signer.Sign(payload)
+		require.NoError(t, err)
+		idToken, err := jws.CompactSerialize()
+		require.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	ti.Server = httptest.NewServer(mux)
+	return ti
+}
+
+func TestOIDCAuth(t *testing.T) {
+	ti := newTestIssuer(t)
+	defer ti.Close()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":    ti.URL,
+			"aud":    "id",
+			"sub":    "1234",
+			"email":  "user@example.com",
+			"name":   "Some User",
+			"locale": "en",
+			"roles":  []string{"a", "b"},
+			"groups": []string{"staff", "admins"},
+			"nonce":  "n0nce",
+			"iat":    time.Now().Unix(),
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	tests := map[string]struct {
+		userClaim     string
+		allowedGroups []string
+		keep          []string
+		claims        func(map[string]interface{})
+		signer        *rsa.PrivateKey
+		id            *state.Identity
+		err           string
+	}{
+		"valid": {
+			id: &state.Identity{
+				User:   "1234",
+				Email:  "user@example.com",
+				Name:   "Some User",
+				Groups: []string{"staff", "admins"},
+			},
+		},
+		"claims": {
+			keep: []string{"locale", "roles", "missing"},
+			id: &state.Identity{
+				User:   "1234",
+				Email:  "user@example.com",
+				Name:   "Some User",
+				Groups: []string{"staff", "admins"},
+				Claims: map[string]string{"locale": "en", "roles": `["a","b"]`},
+			},
+		},
+		"user claim": {
+			userClaim: "email",
+			id: &state.Identity{
+				User:   "user@example.com",
+				Email:  "user@example.com",
+				Name:   "Some User",
+				Groups: []string{"staff", "admins"},
+			},
+		},
+		"unverified user email": {
+			userClaim: "email",
+			claims:    func(c map[string]interface{}) { c["email_verified"] = false },
+			err:       `email "user@example.com" is not verified`,
+		},
+		"unverified email": {
+			claims: func(c map[string]interface{}) { c["email_verified"] = false },
+			id: &state.Identity{
+				User:   "1234",
+				Name:   "Some User",
+				Groups: []string{"staff", "admins"},
+			},
+		},
+		"allowed group": {
+			allowedGroups: []string{"admins"},
+			id: &state.Identity{
+				User:   "1234",
+				Email:  "user@example.com",
+				Name:   "Some User",
+				Groups: []string{"staff", "admins"},
+			},
+		},
+		"disallowed group": {
+			allowedGroups: []string{"ops"},
+			err:           `"1234" is not a member of any allowed group`,
+		},
+		"wrong nonce": {
+			claims: func(c map[string]interface{}) { c["nonce"] = "other" },
+			err:    "id_token nonce mismatch",
+		},
+		"wrong audience": {
+			claims: func(c map[string]interface{}) { c["aud"] = "someone-else" },
+			err:    "expected audience",
+		},
+		"expired": {
+			claims: func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+			err:    "token is expired",
+		},
+		"bad signature": {
+			signer: otherKey,
+			err:    "failed to verify signature",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ti.claims = validClaims()
+			if test.claims != nil {
+				test.claims(ti.claims)
+			}
+			ti.signer = ti.key
+			if test.signer != nil {
+				ti.signer = test.signer
+			}
+
+			auther := &OIDCAuth{
+				Issuer:        ti.URL,
+				ClientID:      "id",
+				ClientSecret:  "secret",
+				UserClaim:     test.userClaim,
+				Claims:        test.keep,
+				AllowedGroups: test.allowedGroups,
+			}
+
+			id, err := auther.AuthNonce("code", "n0nce")
+			if test.err == "" {
+				require.NoError(t, err)
+				assert.Equal(t, test.id, id)
+			} else {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.err)
+			}
+		})
+	}
+}
+
+func TestOIDCAuth_OAuthConfig(t *testing.T) {
+	ti := newTestIssuer(t)
+	defer ti.Close()
+
+	auther := &OIDCAuth{Issuer: ti.URL, ClientID: "id", RedirectURL: "https://oauth.example.com/authorized"}
+	config := auther.OAuthConfig()
+	assert.Equal(t, ti.URL+"/auth", config.Endpoint.AuthURL)
+	assert.Equal(t, []string{"openid", "profile", "email"}, config.Scopes)
+
+	assert.Equal(t, "", auther.LogoutURL("https://example.com/"))
+	auther.EndSession = true
+	assert.Equal(t, ti.URL+"/logout?client_id=id&post_logout_redirect_uri=https%3A%2F%2Fexample.com%2F", auther.LogoutURL("https://example.com/"))
+
+	unreachable := &OIDCAuth{Issuer: fmt.Sprintf("%s/nowhere", ti.URL)}
+	assert.Equal(t, "", unreachable.OAuthConfig().Endpoint.AuthURL)
+}
+
+func TestOIDCAuth_discoveryFailure(t *testing.T) {
+	clock := fakeclock.NewFakeClock(time.Now())
+	globals.Clock = clock
+	defer func() { globals.Clock = realclock.NewClock() }()
+
+	var requests atomic.Int32
+	var available atomic.Bool
+	var issuer *httptest.Server
+	issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if !available.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 issuer.URL,
+			"authorization_endpoint": issuer.URL + "/auth",
+			"token_endpoint":         issuer.URL + "/token",
+			"jwks_uri":               issuer.URL + "/keys",
+		})
+	}))
+	defer issuer.Close()
+
+	auther := &OIDCAuth{Issuer: issuer.URL, ClientID: "id"}
+	assert.Equal(t, "", auther.OAuthConfig().Endpoint.AuthURL)
+	available.Store(true)
+	assert.Equal(t, "", auther.OAuthConfig().Endpoint.AuthURL)
+	assert.EqualValues(t, 1, requests.Load())
+
+	// The failure is only remembered for discoveryRetry.
+	clock.Increment(discoveryRetry)
+	assert.Equal(t, issuer.URL+"/auth", auther.OAuthConfig().Endpoint.AuthURL)
+	assert.EqualValues(t, 2, requests.Load())
+}
+
+func TestHandler_Nonce(t *testing.T) {
+	ts := newTestStore(t, nil, map[string]*state.OAuthState{
+		"testing": {RedirectUrl: "https://some.other/place"},
+	})
+	auther := &nonceMockAuth{MockAuth: MockAuth{User: "user"}}
+	resp := callHandler(t, Handler(auther, ts), "/foo?code=42&state=testing")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, nonce("testing"), auther.nonce)
+}
+
+type nonceMockAuth struct {
+	MockAuth
+	nonce string
+}
+
+func (na *nonceMockAuth) AuthNonce(code, nonce string) (*state.Identity, error) {
+	na.nonce = nonce
+	return na.Auth(code)
+}
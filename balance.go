@@ -0,0 +1,92 @@
+package sohop
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+)
+
+// Load balancing strategies for upstreams with multiple URLs.
+const (
+	RoundRobin       = "round-robin"
+	LeastConnections = "least-connections"
+	Random           = "random"
+)
+
+// A pool balances requests across the targets of a route, skipping targets
+// the health check found unhealthy.  If every target is unhealthy, requests
+// are balanced across all of them anyway.
+type pool struct {
+	strategy string
+	targets  []*target
+	health   *healthReport
+	next     uint64 // round-robin counter
+}
+
+// A target is a single upstream server in a pool.
+type target struct {
+	url    string
+	proxy  *httputil.ReverseProxy
+	active int64 // in-flight requests
+}
+
+func newPool(urls []string, strategy string, transport http.RoundTripper, health *healthReport) (*pool, error) {
+	switch strategy {
+	case "":
+		strategy = RoundRobin
+	case RoundRobin, LeastConnections, Random:
+	default:
+		return nil, fmt.Errorf("unknown balance strategy %q", strategy)
+	}
+
+	p := &pool{strategy: strategy, health: health}
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		proxy := httputil.NewSingleHostReverseProxy(parsed)
+		proxy.Transport = transport
+		p.targets = append(p.targets, &target{url: u, proxy: proxy})
+	}
+	return p, nil
+}
+
+// pick selects the target for the next request.
+func (p *pool) pick() *target {
+	candidates := make([]*target, 0, len(p.targets))
+	for _, t := range p.targets {
+		if p.health.healthy(t.url) {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.targets
+	}
+
+	switch p.strategy {
+	case LeastConnections:
+		best := candidates[0]
+		for _, t := range candidates[1:] {
+			if atomic.LoadInt64(&t.active) < atomic.LoadInt64(&best.active) {
+				best = t
+			}
+		}
+		return best
+	case Random:
+		return candidates[rand.IntN(len(candidates))]
+	default:
+		n := atomic.AddUint64(&p.next, 1) - 1
+		return candidates[n%uint64(len(candidates))]
+	}
+}
+
+func (p *pool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t := p.pick()
+	atomic.AddInt64(&t.active, 1)
+	defer atomic.AddInt64(&t.active, -1)
+	t.proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,61 @@
+package sohop
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool(t *testing.T) {
+	urls := []string{"http://a", "http://b", "http://c"}
+
+	t.Run("round-robin", func(t *testing.T) {
+		p, err := newPool(urls, "", nil, nil)
+		require.NoError(t, err)
+		var picked []string
+		for i := 0; i < 4; i++ {
+			picked = append(picked, p.pick().url)
+		}
+		assert.Equal(t, []string{"http://a", "http://b", "http://c", "http://a"}, picked)
+	})
+
+	t.Run("least-connections", func(t *testing.T) {
+		p, err := newPool(urls, LeastConnections, nil, nil)
+		require.NoError(t, err)
+		p.targets[0].active = 2
+		p.targets[1].active = 1
+		p.targets[2].active = 3
+		assert.Equal(t, "http://b", p.pick().url)
+	})
+
+	t.Run("random", func(t *testing.T) {
+		p, err := newPool(urls, Random, nil, nil)
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			assert.Contains(t, urls, p.pick().url)
+		}
+	})
+
+	t.Run("skips unhealthy", func(t *testing.T) {
+		health := &healthReport{down: map[string]bool{"http://a": true, "http://c": true}}
+		p, err := newPool(urls, RoundRobin, nil, health)
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, "http://b", p.pick().url)
+		}
+	})
+
+	t.Run("all unhealthy", func(t *testing.T) {
+		health := &healthReport{down: map[string]bool{"http://a": true, "http://b": true, "http://c": true}}
+		p, err := newPool(urls, RoundRobin, nil, health)
+		require.NoError(t, err)
+		assert.Equal(t, "http://a", p.pick().url)
+		assert.Equal(t, "http://b", p.pick().url)
+	})
+
+	t.Run("unknown strategy", func(t *testing.T) {
+		_, err := newPool(urls, "fastest", nil, nil)
+		assert.EqualError(t, err, `unknown balance strategy "fastest"`)
+	})
+}
@@ -2,18 +2,29 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/davars/sohop"
+	"github.com/davars/sohop/auth"
+	"github.com/davars/sohop/state"
 )
 
 var (
 	configPath string
 	httpAddr   string
 	httpsAddr  string
+	watch      time.Duration
+	timeout    time.Duration
 )
 
 func check(err error) {
@@ -22,26 +33,162 @@ func check(err error) {
 	}
 }
 
+func readConfig() (*sohop.Config, error) {
+	configData, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &sohop.Config{}
+	if err := json.Unmarshal(configData, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
 func newConfig() *sohop.Config {
 	flag.StringVar(&configPath, "config", "config.json", "Config file")
 	flag.StringVar(&httpAddr, "httpAddr", ":80", "Address to bind HTTP server")
 	flag.StringVar(&httpsAddr, "httpsAddr", ":443", "Address to bind HTTPS server")
+	flag.DurationVar(&timeout, "shutdownTimeout", 30*time.Second, "How long to wait for requests in progress to finish when shutting down")
+	flag.DurationVar(&watch, "watch", 0, "Interval at which to check the config file for changes, and reload it if it has changed (0 to disable)")
 	flag.Parse()
 
-	configData, err := ioutil.ReadFile(configPath)
+	c, err := readConfig()
 	check(err)
 
-	c := &sohop.Config{}
-	err = json.Unmarshal(configData, c)
+	return c
+}
+
+// reload reloads the config file into s.  Invalid configs are logged and
+// otherwise ignored.
+func reload(s *sohop.Server) {
+	c, err := readConfig()
+	if err == nil {
+		err = s.Reload(c)
+	}
+	if err != nil {
+		log.Printf("reload: keeping the previous config: %v", err)
+		return
+	}
+	log.Printf("reload: loaded %s", configPath)
+}
+
+// reloadOnChange reloads the config file into s on SIGHUP, and when its
+// modification time changes if watch is set.
+func reloadOnChange(s *sohop.Server) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	var modTime time.Time
+	if watch > 0 {
+		tick = time.NewTicker(watch).C
+		if fi, err := os.Stat(configPath); err == nil {
+			modTime = fi.ModTime()
+		}
+	}
+
+	for {
+		select {
+		case <-hup:
+			reload(s)
+		case <-tick:
+			fi, err := os.Stat(configPath)
+			if err != nil || fi.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = fi.ModTime()
+			reload(s)
+		}
+	}
+}
+
+// validate implements `sohop validate`, which reports every problem with the
+// config file and exits non-zero if there are any.
+func validate(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "config.json", "Config file")
+	flags.Parse(args)
+
+	c, err := readConfig()
+	if err == nil {
+		err = c.Validate()
+	}
+	if errs, ok := err.(sohop.ConfigErrors); ok {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, e)
+		}
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok\n", configPath)
+}
+
+// apikey implements `sohop apikey`, which generates an API key and prints it
+// with its hash, which goes in the config file.
+func apikey() {
+	key, hash, err := auth.NewAPIKey()
 	check(err)
+	fmt.Printf("key:  %s\nhash: %s\n", key, hash)
+}
 
-	return c
+// token implements `sohop token`, which mints a bearer token for a user.
+func token(args []string) {
+	var (
+		user, email, groups string
+		ttl                 time.Duration
+	)
+	flags := flag.NewFlagSet("token", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "config.json", "Config file")
+	flags.StringVar(&user, "user", "", "User the token identifies (required)")
+	flags.StringVar(&email, "email", "", "User's email address")
+	flags.StringVar(&groups, "groups", "", "Comma-separated groups the user is a member of")
+	flags.DurationVar(&ttl, "ttl", 24*time.Hour, "How long the token is valid for")
+	flags.Parse(args)
+	if user == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	c, err := readConfig()
+	check(err)
+	id := &state.Identity{User: user, Email: email}
+	if groups != "" {
+		id.Groups = strings.Split(groups, ",")
+	}
+	t, err := c.MintToken(id, ttl)
+	check(err)
+	fmt.Println(t)
 }
 
 func main() {
-	sohop.Server{
-		Config:    newConfig(),
-		HTTPAddr:  httpAddr,
-		HTTPSAddr: httpsAddr,
-	}.Run()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			validate(os.Args[2:])
+			return
+		case "apikey":
+			apikey()
+			return
+		case "token":
+			token(os.Args[2:])
+			return
+		}
+	}
+
+	s := &sohop.Server{
+		Config:          newConfig(),
+		HTTPAddr:        httpAddr,
+		HTTPSAddr:       httpsAddr,
+		ShutdownTimeout: timeout,
+	}
+	go reloadOnChange(s)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	check(s.Run(ctx))
 }
@@ -0,0 +1,104 @@
+package sohop
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/davars/sohop/globals"
+	"github.com/davars/sohop/state"
+)
+
+// forwardedURL reconstructs the URL of the original request from the headers
+// set by a forward-auth proxy.  Traefik sets X-Forwarded-Proto,
+// X-Forwarded-Host and X-Forwarded-Uri, and copies any other headers from the
+// client, so X-Original-URL is only used if X-Forwarded-Host isn't set.  It
+// returns "" if the URL can't be determined.
+func forwardedURL(r *http.Request) string {
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return r.Header.Get("X-Original-URL")
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "https"
+	}
+	uri := r.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		uri = "/"
+	}
+	return fmt.Sprintf("%s://%s%s", proto, host, uri)
+}
+
+// forwardedSubdomain returns the subdomain of Domain the original request was
+// made to, if any.
+func (c *Config) forwardedSubdomain(original string) string {
+	u, err := url.Parse(original)
+	if err != nil {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	suffix := "." + strings.ToLower(c.Domain)
+	if !strings.HasSuffix(host, suffix) {
+		return ""
+	}
+	return strings.TrimSuffix(host, suffix)
+}
+
+// VerifyHandler implements the endpoint used by forward-auth proxies (nginx's
+// auth_request, Traefik's ForwardAuth) to check whether a request may proceed.
+//
+// If the user is logged in (and satisfies the Policy of the upstream whose
+// subdomain the request was made to, if any), it responds with 200 and the
+// user's identity in X-Auth-Request-User, X-Auth-Request-Email,
+// X-Auth-Request-Name and X-Auth-Request-Groups.  Users that don't satisfy
+// the policy get a 403.
+//
+// Otherwise it responds with 401 and the URL that logs the user in (and then
+// returns them to the original request) in X-Auth-Request-Redirect.  If the
+// "redirect" query parameter is set, it instead redirects to that URL.
+func (s Server) VerifyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		original := forwardedURL(r)
+		session := s.storeConfig.GetSession(r)
+		setUser(r, session.User)
+		subdomain := s.Config.forwardedSubdomain(original)
+		upstream, isUpstream := s.Config.Upstreams[subdomain]
+		if isUpstream && upstream.SessionMaxAge > 0 {
+			r = state.WithMaxAge(r, time.Duration(upstream.SessionMaxAge))
+		}
+
+		if !s.storeConfig.IsAuthorized(r) {
+			login := fmt.Sprintf("https://oauth.%s/start", s.Config.Domain)
+			if original != "" {
+				login += "?rd=" + url.QueryEscape(original)
+			}
+			if r.URL.Query().Get("redirect") != "" {
+				http.Redirect(w, r, login, http.StatusFound)
+				return
+			}
+			w.Header().Set("X-Auth-Request-Redirect", login)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if isUpstream {
+			if err := upstream.Policy.allows(session.User, session.Email, session.Groups); err != nil {
+				denied(w, r, subdomain, session.User, original, err)
+				return
+			}
+		}
+
+		if err := s.storeConfig.Touch(w, r); err != nil {
+			globals.Logger(r.Context()).Error("renewing session", "error", err)
+		}
+
+		w.Header().Set("X-Auth-Request-User", session.User)
+		w.Header().Set("X-Auth-Request-Email", session.Email)
+		w.Header().Set("X-Auth-Request-Name", session.Name)
+		w.Header().Set("X-Auth-Request-Groups", strings.Join(session.Groups, ","))
+		w.WriteHeader(http.StatusOK)
+	})
+}
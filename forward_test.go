@@ -0,0 +1,104 @@
+package sohop
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/davars/sohop/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyHandler(t *testing.T) {
+	store, err := state.New("test", "3c0767ada2466a92a59c1214061441713aeafe6d115e29aa376c0f9758cdf0f5", "example.com")
+	require.NoError(t, err)
+
+	s := Server{
+		Config: &Config{
+			Domain: "example.com",
+			Upstreams: map[string]UpstreamConfig{
+				"admin": {Policy: &Policy{Users: []string{"root"}}},
+			},
+		},
+		storeConfig: store,
+	}
+	handler := s.VerifyHandler()
+
+	tests := map[string]struct {
+		id       *state.Identity
+		query    string
+		headers  map[string]string
+		status   int
+		response map[string]string
+	}{
+		"unauthorized": {
+			headers: map[string]string{"X-Forwarded-Host": "app.example.com", "X-Forwarded-Uri": "/path?q=1"},
+			status:  http.StatusUnauthorized,
+			response: map[string]string{
+				"X-Auth-Request-Redirect": "https://oauth.example.com/start?rd=https%3A%2F%2Fapp.example.com%2Fpath%3Fq%3D1",
+			},
+		},
+		"unauthorized redirect": {
+			query:   "?redirect=true",
+			headers: map[string]string{"X-Forwarded-Proto": "http", "X-Forwarded-Host": "app.example.com"},
+			status:  http.StatusFound,
+			response: map[string]string{
+				"Location": "https://oauth.example.com/start?rd=http%3A%2F%2Fapp.example.com%2F",
+			},
+		},
+		"unauthorized original url": {
+			headers: map[string]string{"X-Original-URL": "https://app.example.com/x"},
+			status:  http.StatusUnauthorized,
+			response: map[string]string{
+				"X-Auth-Request-Redirect": "https://oauth.example.com/start?rd=https%3A%2F%2Fapp.example.com%2Fx",
+			},
+		},
+		"original url and forwarded host": {
+			id: &state.Identity{User: "octocat"},
+			headers: map[string]string{
+				"X-Forwarded-Host": "admin.example.com",
+				"X-Original-URL":   "https://app.example.com/",
+			},
+			status: http.StatusForbidden,
+		},
+		"authorized": {
+			id:      &state.Identity{User: "octocat", Email: "octocat@example.com", Name: "Octocat", Groups: []string{"acme", "acme/ops"}},
+			headers: map[string]string{"X-Forwarded-Host": "app.example.com"},
+			status:  http.StatusOK,
+			response: map[string]string{
+				"X-Auth-Request-User":   "octocat",
+				"X-Auth-Request-Email":  "octocat@example.com",
+				"X-Auth-Request-Name":   "Octocat",
+				"X-Auth-Request-Groups": "acme,acme/ops",
+			},
+		},
+		"policy allowed": {
+			id:       &state.Identity{User: "root"},
+			headers:  map[string]string{"X-Forwarded-Host": "admin.example.com"},
+			status:   http.StatusOK,
+			response: map[string]string{"X-Auth-Request-User": "root"},
+		},
+		"policy denied": {
+			id:      &state.Identity{User: "octocat"},
+			headers: map[string]string{"X-Forwarded-Host": "admin.example.com"},
+			status:  http.StatusForbidden,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := authorizedRequest(t, store, "https://oauth.example.com/verify"+test.query, test.id)
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			assert.Equal(t, test.status, rw.Code)
+			for k, v := range test.response {
+				assert.Equal(t, v, rw.Header().Get(k), k)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package sohop
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/davars/sohop/globals"
+)
+
+// trustedProxies are the networks of the proxies whose forwarding headers are
+// believed.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxy parses an IP address or CIDR.
+func parseTrustedProxy(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not an IP address or CIDR", s)
+	}
+	return network, nil
+}
+
+// trustedProxies returns the parsed TrustedProxies.
+func (c *Config) trustedProxies() (trustedProxies, error) {
+	var trusted trustedProxies
+	for _, s := range c.TrustedProxies {
+		network, err := parseTrustedProxy(s)
+		if err != nil {
+			return nil, err
+		}
+		trusted = append(trusted, network)
+	}
+	return trusted, nil
+}
+
+func (t trustedProxies) contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwarded describes where a request came from.
+type forwarded struct {
+	// hops are the address of the client followed by those of the trusted
+	// proxies the request passed through, the last of which connected to
+	// sohop.
+	hops []string
+
+	// proto and host are the scheme and host the client used.
+	proto string
+	host  string
+}
+
+func (f *forwarded) client() string {
+	return f.hops[0]
+}
+
+// A forwardedElement is one element of a Forwarded header (RFC 7239), or
+// the equivalent from X-Forwarded-* headers.
+type forwardedElement struct {
+	node  string
+	proto string
+	host  string
+}
+
+// resolve determines where r came from.  If it was made by a trusted proxy,
+// its Forwarded header (or failing that, its X-Forwarded-For,
+// X-Forwarded-Proto and X-Forwarded-Host headers) is followed back through
+// any other trusted proxies to the client.  Otherwise the headers are
+// ignored.
+func (t trustedProxies) resolve(r *http.Request) *forwarded {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	f := &forwarded{hops: []string{peer}, proto: "http", host: r.Host}
+	if r.TLS != nil {
+		f.proto = "https"
+	}
+	if !t.contains(peer) {
+		return f
+	}
+
+	var elements []forwardedElement
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		elements = parseForwarded(values)
+	} else {
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			for _, node := range strings.Split(v, ",") {
+				elements = append(elements, forwardedElement{node: strings.TrimSpace(node)})
+			}
+		}
+		// Like the addresses, the scheme and host are taken from the
+		// values added last, by the trusted proxy.
+		last := func(name string) string {
+			values := r.Header.Values(name)
+			if len(values) == 0 {
+				return ""
+			}
+			parts := strings.Split(values[len(values)-1], ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+		if len(elements) == 0 {
+			elements = append(elements, forwardedElement{})
+		}
+		elements[len(elements)-1].proto = last("X-Forwarded-Proto")
+		elements[len(elements)-1].host = last("X-Forwarded-Host")
+	}
+
+	// Each element was added by the proxy at the front of hops, which is
+	// trusted, and describes the request it received.
+	for i := len(elements) - 1; i >= 0; i-- {
+		e := elements[i]
+		switch strings.ToLower(e.proto) {
+		case "http", "https":
+			f.proto = strings.ToLower(e.proto)
+		}
+		if e.host != "" {
+			f.host = e.host
+		}
+		if net.ParseIP(e.node) == nil {
+			// Unknown or obfuscated, so the client can't be identified.
+			break
+		}
+		f.hops = append([]string{e.node}, f.hops...)
+		if !t.contains(e.node) {
+			break
+		}
+	}
+	return f
+}
+
+// parseForwarded parses the elements of Forwarded headers.  Unknown
+// parameters are ignored.
+func parseForwarded(values []string) []forwardedElement {
+	var elements []forwardedElement
+	for _, v := range values {
+		for _, element := range splitQuoted(v, ',') {
+			var e forwardedElement
+			for _, pair := range splitQuoted(element, ';') {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				value = strings.Trim(value, `"`)
+				switch strings.ToLower(key) {
+				case "for":
+					e.node = forwardedNodeIP(value)
+				case "proto":
+					e.proto = value
+				case "host":
+					e.host = value
+				}
+			}
+			elements = append(elements, e)
+		}
+	}
+	return elements
+}
+
+// splitQuoted splits s at sep, except within quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// forwardedNodeIP returns the IP address of a node (e.g. "192.0.2.1:4711"
+// or "[2001:db8::1]"), or the node itself if it's not an address.
+func forwardedNodeIP(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
+
+// forwardedNode formats an address as a Forwarded node.
+func forwardedNode(addr string) string {
+	if strings.Contains(addr, ":") {
+		return `"[` + addr + `]"`
+	}
+	return addr
+}
+
+// setHeaders replaces the forwarding headers in h, which will be sent
+// upstream, with those describing f.
+func (f *forwarded) setHeaders(h http.Header) {
+	nodes := make([]string, len(f.hops))
+	for i, hop := range f.hops {
+		nodes[i] = "for=" + forwardedNode(hop)
+	}
+	nodes[0] += fmt.Sprintf(";host=%q;proto=%s", f.host, f.proto)
+
+	h.Set("Forwarded", strings.Join(nodes, ", "))
+	h.Set("X-Forwarded-For", strings.Join(f.hops, ", "))
+	h.Set("X-Forwarded-Proto", f.proto)
+	h.Set("X-Forwarded-Host", f.host)
+}
+
+type forwardedKey struct{}
+
+func forwardedFrom(ctx context.Context) *forwarded {
+	f, _ := ctx.Value(forwardedKey{}).(*forwarded)
+	return f
+}
+
+// withForwarded returns a copy of r carrying where it came from (see
+// resolve), whose Host is the one the client used and whose RemoteAddr is the
+// client's address.  The address has no port, so the upstream proxies, which
+// only add RemoteAddr to X-Forwarded-For if it has one, leave the headers set
+// by setHeaders alone.
+func withForwarded(r *http.Request, trusted trustedProxies) (*http.Request, *forwarded) {
+	f := trusted.resolve(r)
+	ctx := context.WithValue(r.Context(), forwardedKey{}, f)
+	ctx = globals.WithScheme(ctx, f.proto)
+	r = r.WithContext(ctx)
+	r.Host = f.host
+	r.RemoteAddr = f.client()
+	return r, f
+}
+
+// forwarding returns a middleware that determines where each request came
+// from, believing the forwarding headers of trusted proxies.  Requests to
+// verifyHost's /verify keep their Host: the headers of forward-auth requests
+// describe the request being authorized rather than the one made to sohop.
+func forwarding(trusted trustedProxies, verifyHost string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		r, _ = withForwarded(r, trusted)
+		if r.URL.Path == "/verify" && strings.EqualFold(hostname(host), verifyHost) {
+			r.Host = host
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hostname returns host without its port, if it has one.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
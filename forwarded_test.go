@@ -0,0 +1,208 @@
+package sohop
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/davars/sohop/auth"
+	"github.com/davars/sohop/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedProxies_resolve(t *testing.T) {
+	trusted, err := (&Config{TrustedProxies: []string{"10.0.0.0/8", "2001:db8::1"}}).trustedProxies()
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		remoteAddr string
+		tls        bool
+		header     http.Header
+		hops       []string
+		proto      string
+		host       string
+	}{
+		"direct": {
+			remoteAddr: "192.0.2.1:1234",
+			tls:        true,
+			hops:       []string{"192.0.2.1"},
+			proto:      "https",
+			host:       "app.example.com",
+		},
+		"spoofed": {
+			remoteAddr: "192.0.2.1:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"10.1.1.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"evil.example.org"},
+				"Forwarded":         {"for=10.1.1.1;proto=https"},
+			},
+			hops:  []string{"192.0.2.1"},
+			proto: "http",
+			host:  "app.example.com",
+		},
+		"x-forwarded": {
+			remoteAddr: "10.0.0.2:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"203.0.113.9, 198.51.100.7"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"app.example.com"},
+			},
+			hops:  []string{"198.51.100.7", "10.0.0.2"},
+			proto: "https",
+			host:  "app.example.com",
+		},
+		"chain of trusted proxies": {
+			remoteAddr: "10.0.0.2:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.7, 10.0.0.3", "10.0.0.4"}},
+			hops:       []string{"198.51.100.7", "10.0.0.3", "10.0.0.4", "10.0.0.2"},
+			proto:      "http",
+			host:       "app.example.com",
+		},
+		"proto only": {
+			remoteAddr: "10.0.0.2:1234",
+			header:     http.Header{"X-Forwarded-Proto": {"HTTPS"}},
+			hops:       []string{"10.0.0.2"},
+			proto:      "https",
+			host:       "app.example.com",
+		},
+		"forwarded": {
+			remoteAddr: "[2001:db8::1]:1234",
+			header: http.Header{
+				"Forwarded":       {`for=198.51.100.7;proto=http, for="[2001:db8:cafe::17]:4711";host="app.example.com";proto=https`},
+				"X-Forwarded-For": {"192.0.2.200"},
+			},
+			hops:  []string{"2001:db8:cafe::17", "2001:db8::1"},
+			proto: "https",
+			host:  "app.example.com",
+		},
+		"obfuscated": {
+			remoteAddr: "10.0.0.2:1234",
+			header:     http.Header{"Forwarded": {"for=_hidden;proto=https"}},
+			hops:       []string{"10.0.0.2"},
+			proto:      "https",
+			host:       "app.example.com",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+			req.RemoteAddr = test.remoteAddr
+			if test.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range test.header {
+				req.Header[k] = v
+			}
+			f := trusted.resolve(req)
+			assert.Equal(t, test.hops, f.hops)
+			assert.Equal(t, test.proto, f.proto)
+			assert.Equal(t, test.host, f.host)
+		})
+	}
+
+	_, err = (&Config{TrustedProxies: []string{"10.0.0.0/33"}}).trustedProxies()
+	assert.EqualError(t, err, `"10.0.0.0/33" is not an IP address or CIDR`)
+}
+
+func TestForwarded_setHeaders(t *testing.T) {
+	h := http.Header{}
+	(&forwarded{hops: []string{"2001:db8::17", "10.0.0.2"}, proto: "https", host: "app.example.com"}).setHeaders(h)
+	assert.Equal(t, `for="[2001:db8::17]";host="app.example.com";proto=https, for=10.0.0.2`, h.Get("Forwarded"))
+	assert.Equal(t, "2001:db8::17, 10.0.0.2", h.Get("X-Forwarded-For"))
+	assert.Equal(t, "https", h.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "app.example.com", h.Get("X-Forwarded-Host"))
+}
+
+func TestProxyHandler_Forwarded(t *testing.T) {
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	s := &Server{Config: &Config{
+		Domain:         "example.com",
+		Upstreams:      map[string]UpstreamConfig{"app": {URL: upstream.URL}},
+		Auth:           auth.Config{Type: "mock", Config: json.RawMessage(`{}`)},
+		TLS:            TLSConfig{CertFile: "fixtures/cert.pem", CertKey: "fixtures/key.pem"},
+		TrustedProxies: []string{"10.0.0.0/8"},
+	}}
+	require.NoError(t, s.Reload(s.Config))
+
+	request := func(remoteAddr string) {
+		req := httptest.NewRequest("GET", "https://app.example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		req.Header.Set("X-Forwarded-Proto", "http")
+		req.Header.Set("Forwarded", "for=203.0.113.9;proto=http")
+		rw := httptest.NewRecorder()
+		s.reloadable().ServeHTTP(rw, req)
+		require.Equal(t, http.StatusOK, rw.Code)
+	}
+
+	// Untrusted clients can't spoof their address.
+	request("192.0.2.1:1234")
+	assert.Equal(t, []string{"192.0.2.1"}, received.Values("X-Forwarded-For"))
+	assert.Equal(t, "https", received.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "app.example.com", received.Get("X-Forwarded-Host"))
+	assert.Equal(t, `for=192.0.2.1;host="app.example.com";proto=https`, received.Get("Forwarded"))
+
+	request("10.0.0.2:1234")
+	assert.Equal(t, []string{"203.0.113.9, 10.0.0.2"}, received.Values("X-Forwarded-For"))
+	assert.Equal(t, "http", received.Get("X-Forwarded-Proto"))
+	assert.Equal(t, `for=203.0.113.9;host="app.example.com";proto=http, for=10.0.0.2`, received.Get("Forwarded"))
+}
+
+func TestForwarding_Host(t *testing.T) {
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+	defer upstream.Close()
+
+	s := &Server{Config: &Config{
+		Domain: "example.com",
+		Upstreams: map[string]UpstreamConfig{
+			"app":     {URL: upstream.URL},
+			"private": {URL: upstream.URL, Policy: &Policy{Users: []string{"root"}}},
+		},
+		Auth:           auth.Config{Type: "mock", Config: json.RawMessage(`{}`)},
+		TLS:            TLSConfig{CertFile: "fixtures/cert.pem", CertKey: "fixtures/key.pem"},
+		TrustedProxies: []string{"10.0.0.0/8"},
+	}}
+	require.NoError(t, s.Reload(s.Config))
+	store, err := s.current().Config.storeConfig(nil)
+	require.NoError(t, err)
+
+	serve := func(req *http.Request, host, forwardedHost string) *httptest.ResponseRecorder {
+		req.Host = host
+		req.RemoteAddr = "10.0.0.2:1234"
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", forwardedHost)
+		rw := httptest.NewRecorder()
+		s.reloadable().ServeHTTP(rw, req)
+		return rw
+	}
+
+	// Requests are routed by the host the client used.
+	rw := serve(httptest.NewRequest("GET", "/", nil), "lb.internal", "app.example.com")
+	require.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "app.example.com", received.Header.Get("X-Forwarded-Host"))
+
+	// Pages sohop serves itself use that host too.
+	rw = serve(authorizedRequest(t, store, "/path", &state.Identity{User: "guest"}), "lb.internal", "private.example.com")
+	require.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Contains(t, rw.Body.String(), "<code>private.example.com</code>")
+
+	// Forward-auth requests describe the request being authorized.
+	rw = serve(httptest.NewRequest("GET", "/verify", nil), "oauth.example.com", "app.example.com")
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.Equal(t, "https://oauth.example.com/start?rd="+url.QueryEscape("https://app.example.com/"), rw.Header().Get("X-Auth-Request-Redirect"))
+}
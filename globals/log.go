@@ -0,0 +1,22 @@
+package globals
+
+import (
+	"context"
+	"log/slog"
+)
+
+type loggerKey struct{}
+
+// Logger returns the logger carried by ctx, or slog.Default() if there isn't
+// one.  Loggers carried by a request's context include its request ID.
+func Logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// WithLogger returns a copy of ctx carrying l.
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
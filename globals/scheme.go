@@ -0,0 +1,27 @@
+package globals
+
+import (
+	"context"
+	"net/http"
+)
+
+type schemeKey struct{}
+
+// Scheme returns the scheme ("http" or "https") the client used to make r.
+// It's the scheme carried by r's context (see WithScheme), which may have
+// been reported by a trusted proxy, or else depends on whether r was made
+// over TLS.
+func Scheme(r *http.Request) string {
+	if scheme, ok := r.Context().Value(schemeKey{}).(string); ok {
+		return scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// WithScheme returns a copy of ctx carrying scheme.
+func WithScheme(ctx context.Context, scheme string) context.Context {
+	return context.WithValue(ctx, schemeKey{}, scheme)
+}
@@ -0,0 +1,157 @@
+package sohop
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// templateFuncs are the functions available to header templates, in addition
+// to the text/template builtins.
+var templateFuncs = template.FuncMap{
+	// base64 returns the standard base64 encoding of s.
+	"base64": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	// join joins elems with sep: {{.Session.Groups | join ","}}.
+	"join": func(sep string, elems []string) string {
+		return strings.Join(elems, sep)
+	},
+	// default returns def if value is empty: {{.Session.Email | default "none"}}.
+	"default": func(def, value interface{}) interface{} {
+		if truth, _ := template.IsTrue(value); !truth {
+			return def
+		}
+		return value
+	},
+	// hmac returns the hex-encoded HMAC-SHA256 of message with key:
+	// {{.Session.User | hmac "secret"}}.
+	"hmac": func(key, message string) string {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(message))
+		return hex.EncodeToString(mac.Sum(nil))
+	},
+}
+
+// A headerTemplate maps header names to templates for their values.
+type headerTemplate map[string][]*template.Template
+
+// parseHeaderTemplate parses the template for a header value.
+func parseHeaderTemplate(text string) (*template.Template, error) {
+	return template.New("").Funcs(templateFuncs).Parse(text)
+}
+
+// newHeaderTemplate parses the templates in h.
+func newHeaderTemplate(h http.Header) (headerTemplate, error) {
+	templates := make(headerTemplate, len(h))
+	for k, vs := range h {
+		for _, v := range vs {
+			t, err := parseHeaderTemplate(v)
+			if err != nil {
+				return nil, fmt.Errorf("header %q: %v", k, err)
+			}
+			templates[http.CanonicalHeaderKey(k)] = append(templates[http.CanonicalHeaderKey(k)], t)
+		}
+	}
+	return templates, nil
+}
+
+// apply replaces the headers in h with the values of their templates.
+func (t headerTemplate) apply(h http.Header, data *TemplateData) error {
+	for k, vs := range t {
+		values := make([]string, 0, len(vs))
+		for _, v := range vs {
+			buf := &bytes.Buffer{}
+			if err := v.Execute(buf, data); err != nil {
+				return fmt.Errorf("header %q: %v", k, err)
+			}
+			values = append(values, buf.String())
+		}
+		h[k] = values
+	}
+	return nil
+}
+
+// validateHeaderTemplates reports the templates in h that can't be parsed,
+// in a stable order.
+func validateHeaderTemplates(path string, h http.Header, add func(string, error)) {
+	names := make([]string, 0, len(h))
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		for i, v := range h[k] {
+			if _, err := parseHeaderTemplate(v); err != nil {
+				add(fmt.Sprintf("%s.%s[%d]", path, k, i), err)
+			}
+		}
+	}
+}
+
+// A headerWriter applies an upstream's response header rules just before the
+// response header is written.
+type headerWriter struct {
+	http.ResponseWriter
+	remove  []string
+	set     http.Header
+	applied bool
+}
+
+func (w *headerWriter) apply() {
+	if w.applied {
+		return
+	}
+	w.applied = true
+	h := w.Header()
+	for _, k := range w.remove {
+		h.Del(k)
+	}
+	for k, vs := range w.set {
+		h[k] = vs
+	}
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	// Informational responses other than 101 are followed by the real one.
+	if code >= http.StatusOK || code == http.StatusSwitchingProtocols {
+		w.apply()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends any buffered data to the client, after applying the rules if
+// the header hasn't been written yet.
+func (w *headerWriter) Flush() {
+	w.apply()
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack applies the rules to upgrade responses written by the proxy after
+// hijacking the connection.
+func (w *headerWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.apply()
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying
+// ResponseWriter.
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,94 @@
+package sohop
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/davars/sohop/auth"
+	"github.com/davars/sohop/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	data := &TemplateData{Session: Session{User: "Octocat", Groups: []string{"staff", "admins"}}}
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{template: `{{.Session.User | lower}}`, want: "octocat"},
+		{template: `{{.Session.User | upper}}`, want: "OCTOCAT"},
+		{template: `{{.Session.User | base64}}`, want: "T2N0b2NhdA=="},
+		{template: `{{.Session.Groups | join ","}}`, want: "staff,admins"},
+		{template: `{{.Session.Email | default "nobody@example.com"}}`, want: "nobody@example.com"},
+		{template: `{{.Session.User | default "nobody"}}`, want: "Octocat"},
+		{template: `{{.Session.User | hmac "hunter2"}}`, want: "3c6ede258a177f10d1db22eb2e726c85c27f99bed5aeb48de4f184266862abae"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			tmpl, err := parseHeaderTemplate(test.template)
+			require.NoError(t, err)
+			buf := &bytes.Buffer{}
+			require.NoError(t, tmpl.Execute(buf, data))
+			assert.Equal(t, test.want, buf.String())
+		})
+	}
+}
+
+func TestProxyHandler_Headers(t *testing.T) {
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("Server", "nginx/1.0")
+		w.Header().Set("X-Powered-By", "PHP")
+		w.Header().Set("X-Upstream", "kept")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	s := &Server{Config: &Config{
+		Domain: "example.com",
+		Upstreams: map[string]UpstreamConfig{"app": {
+			URL:    upstream.URL,
+			Auth:   true,
+			Routes: []RouteConfig{{Path: "/api", URL: upstream.URL, StripPrefix: true}},
+			Headers: http.Header{
+				"X-Forwarded-Email": {"{{.Session.Email | default .Session.User}}"},
+				"X-Original":        {"{{.Request.Method}} {{.Request.Host}}{{.Request.Path}}?{{.Request.Query}} from {{.Request.RemoteIP}}"},
+				"X-Client-Token":    {`{{index .Request.Header "X-Token" | join ""}}`},
+				"X-Upstream":        {"{{.Upstream}}"},
+			},
+			RemoveHeaders:         []string{"X-Token", "Cookie"},
+			ResponseHeaders:       http.Header{"X-Served-To": {"{{.Session.User}}"}},
+			RemoveResponseHeaders: []string{"Server", "X-Powered-By"},
+		}},
+		Auth: auth.Config{Type: "mock", Config: json.RawMessage(`{}`)},
+		TLS:  TLSConfig{CertFile: "fixtures/cert.pem", CertKey: "fixtures/key.pem"},
+	}}
+	require.NoError(t, s.Reload(s.Config))
+	store, err := s.current().Config.storeConfig(nil)
+	require.NoError(t, err)
+
+	req := authorizedRequest(t, store, "https://app.example.com/api/users?page=2", &state.Identity{User: "octocat"})
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Token", "secret")
+	rw := httptest.NewRecorder()
+	s.reloadable().ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+
+	assert.Equal(t, "octocat", received.Get("X-Forwarded-Email"))
+	assert.Equal(t, "GET app.example.com/api/users?page=2 from 192.0.2.1", received.Get("X-Original"))
+	assert.Equal(t, "secret", received.Get("X-Client-Token"))
+	assert.Equal(t, "app", received.Get("X-Upstream"))
+	assert.Empty(t, received.Get("X-Token"))
+	assert.Empty(t, received.Get("Cookie"))
+
+	assert.Equal(t, "octocat", rw.Header().Get("X-Served-To"))
+	assert.Equal(t, "kept", rw.Header().Get("X-Upstream"))
+	assert.Empty(t, rw.Header().Get("Server"))
+	assert.Empty(t, rw.Header().Get("X-Powered-By"))
+}
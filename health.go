@@ -1,41 +1,133 @@
 package sohop
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/davars/sohop/globals"
 )
 
-var healthClient = createHealthClient()
-
-const certWarning = 72 * time.Hour
+const (
+	certWarning    = 72 * time.Hour
+	healthInterval = 5 * time.Second
+	healthTimeout  = 5 * time.Second
+)
 
-func createHealthClient() *http.Client {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // codeql[go/disabled-certificate-check]
-	}
-	client := &http.Client{
-		Transport: tr,
-		Timeout:   5 * time.Second,
+// healthClients returns the clients used to check the health of each
+// upstream's servers.  They're created when the config is loaded, so changes
+// to the upstreams' CA and certificate files take effect on reload.
+func (c *Config) healthClients() (map[string]*http.Client, error) {
+	clients := make(map[string]*http.Client, len(c.Upstreams))
+	for name, spec := range c.Upstreams {
+		tlsConfig, err := spec.TLS.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %v", name, err)
+		}
+		clients[name] = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   healthTimeout,
+		}
 	}
-	return client
+	return clients, nil
 }
 
 type healthStatus struct {
 	Response  string        `json:"response"`
 	LatencyMS time.Duration `json:"latency_ms"`
+
+	// Targets holds the status of each server of an upstream with more than
+	// one, keyed by its index in the upstream's health checks ("0", "1"
+	// etc.) so the servers' addresses aren't published.
+	Targets map[string]healthStatus `json:"targets,omitempty"`
+
+	ok bool
 }
 
 type healthReport struct {
 	sync.RWMutex
-	response []byte
-	allOk    bool
+	response  []byte
+	allOk     bool
+	upstreams map[string]healthStatus
+	cert      map[string]interface{}
+
+	// down holds the servers that failed their last health check.  It has
+	// its own lock so proxying isn't blocked while checks are in progress.
+	downLock sync.RWMutex
+	down     map[string]bool
+}
+
+// healthy returns false if the server with the given URL failed its last
+// health check.  A nil report considers every server healthy.
+func (h *healthReport) healthy(target string) bool {
+	if h == nil {
+		return true
+	}
+	h.downLock.RLock()
+	defer h.downLock.RUnlock()
+	return !h.down[target]
+}
+
+// A healthCheck is a request made to check the health of an upstream server.
+type healthCheck struct {
+	target string // the server's URL, as configured
+	url    string // the URL requested
+}
+
+// healthChecks returns the checks to perform for an upstream, one for each of
+// its servers.
+func (spec UpstreamConfig) healthChecks() []healthCheck {
+	var checks []healthCheck
+	seen := map[string]bool{}
+	for _, rt := range spec.routeConfigs() {
+		urls := rt.urls()
+		for _, u := range urls {
+			if seen[u] {
+				continue
+			}
+			seen[u] = true
+			checks = append(checks, healthCheck{target: u, url: healthCheckURL(u, rt.HealthCheck, len(urls) == 1)})
+		}
+	}
+	if len(checks) == 0 {
+		checks = append(checks, healthCheck{target: spec.HealthCheck, url: spec.HealthCheck})
+	}
+	return checks
+}
+
+// healthCheckURL returns the URL to request to check the health of server.
+// An absolute check URL is used as-is if the server is the only one;
+// otherwise only its path and query are used.
+func healthCheckURL(server, check string, only bool) string {
+	if check == "" {
+		return server
+	}
+	c, err := url.Parse(check)
+	if err != nil || (c.IsAbs() && only) {
+		return check
+	}
+	base, err := url.Parse(server)
+	if err != nil {
+		return server
+	}
+	return base.ResolveReference(&url.URL{Path: c.Path, RawQuery: c.RawQuery}).String()
+}
+
+func checkHealth(client *http.Client, checkURL string) healthStatus {
+	start := globals.Clock.Now()
+	resp, err := client.Get(checkURL)
+	elapsed := time.Since(start) / time.Millisecond
+	if err != nil {
+		return healthStatus{Response: err.Error(), LatencyMS: elapsed}
+	}
+	resp.Body.Close()
+	return healthStatus{Response: resp.Status, LatencyMS: elapsed, ok: resp.StatusCode == 200}
 }
 
 func (s Server) performCheck() {
@@ -43,40 +135,35 @@ func (s Server) performCheck() {
 	defer s.health.Unlock()
 
 	allOk := true
-	responses := make(map[string]healthStatus)
+	checks := make(map[string][]healthCheck)
+	targets := make(map[string][]healthStatus) // in the order of checks
+	down := make(map[string]bool)
 
-	var lock sync.Mutex // responses
+	var lock sync.Mutex // down
 	var wg sync.WaitGroup
 
 	for k, v := range s.Config.Upstreams {
-		k := k
-		v := v
-
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
-			healthCheck := v.HealthCheck
-			if healthCheck == "" {
-				healthCheck = v.URL
-			}
+		checks[k] = v.healthChecks()
+		targets[k] = make([]healthStatus, len(checks[k]))
+		client := s.healthClients[k]
+		for i, check := range checks[k] {
+			statuses := targets[k]
+			i := i
+			check := check
 
-			start := globals.Clock.Now()
-			resp, err := healthClient.Get(healthCheck)
-			elapsed := time.Since(start) / time.Millisecond
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
 
-			lock.Lock()
-			defer lock.Unlock()
-			if err == nil {
-				responses[k] = healthStatus{Response: resp.Status, LatencyMS: elapsed}
-				if resp.StatusCode != 200 {
-					allOk = false
+				status := checkHealth(client, check.url)
+				statuses[i] = status
+				lock.Lock()
+				defer lock.Unlock()
+				if !status.ok {
+					down[check.target] = true
 				}
-			} else {
-				responses[k] = healthStatus{Response: err.Error(), LatencyMS: elapsed}
-				allOk = false
-			}
-		}()
+			}()
+		}
 	}
 
 	var certResponse map[string]interface{}
@@ -99,6 +186,7 @@ func (s Server) performCheck() {
 			}
 
 			certResponse["expires_at"] = notAfter
+			certExpiry.Set(float64(notAfter.Unix()))
 			now := globals.Clock.Now()
 			if !notBefore.Before(now) {
 				certResponse["error"] = "not yet valid"
@@ -119,6 +207,65 @@ func (s Server) performCheck() {
 
 	wg.Wait()
 
+	s.health.downLock.Lock()
+	previous := s.health.down
+	s.health.down = down
+	s.health.downLock.Unlock()
+
+	logger := s.logger()
+	for k, statuses := range targets {
+		for i, status := range statuses {
+			target := checks[k][i].target
+			if !status.ok && !previous[target] {
+				logger.Warn("upstream server is down", "upstream", k, "target", target, "response", status.Response)
+			} else if status.ok && previous[target] {
+				logger.Info("upstream server is up", "upstream", k, "target", target)
+			}
+		}
+	}
+
+	upstreamUp.Reset()
+	upstreamCheckDuration.Reset()
+	for k, statuses := range targets {
+		for i, status := range statuses {
+			// By index, like the report's targets.
+			target := strconv.Itoa(i)
+			up := 0.0
+			if status.ok {
+				up = 1
+			}
+			upstreamUp.WithLabelValues(k, target).Set(up)
+			upstreamCheckDuration.WithLabelValues(k, target).Set(float64(status.LatencyMS) / 1000)
+		}
+	}
+
+	responses := make(map[string]healthStatus, len(targets))
+	for k, statuses := range targets {
+		if len(statuses) == 1 {
+			for _, status := range statuses {
+				responses[k] = status
+				allOk = allOk && status.ok
+			}
+			continue
+		}
+
+		healthy := 0
+		summary := healthStatus{Targets: make(map[string]healthStatus, len(statuses))}
+		for i, status := range statuses {
+			summary.Targets[strconv.Itoa(i)] = status
+			if status.ok {
+				healthy++
+			}
+			if status.LatencyMS > summary.LatencyMS {
+				summary.LatencyMS = status.LatencyMS
+			}
+		}
+		summary.Response = fmt.Sprintf("%d/%d healthy", healthy, len(statuses))
+		summary.ok = healthy == len(statuses)
+		responses[k] = summary
+		allOk = allOk && healthy == len(statuses)
+	}
+
 	if certResponse != nil {
 		allOk = allOk && certResponse["ok"].(bool)
 	}
@@ -133,12 +280,27 @@ func (s Server) performCheck() {
 	if err != nil {
 		s.health.response = []byte("internal server error")
 		s.health.allOk = false
-		log.Print(err)
+		logger.Error("health check", "error", err)
 		return
 	}
 
 	s.health.allOk = allOk
 	s.health.response = res
+	s.health.upstreams = responses
+	s.health.cert = certResponse
+}
+
+// monitor checks the health of the current upstreams every healthInterval
+// until ctx is done.
+func (s *Server) monitor(ctx context.Context) {
+	for {
+		s.current().performCheck()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(healthInterval):
+		}
+	}
 }
 
 // HealthHandler checks each upstream and considers them healthy if they return
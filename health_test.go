@@ -0,0 +1,133 @@
+package sohop
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/davars/sohop/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthChecks(t *testing.T) {
+	tests := map[string]struct {
+		spec   UpstreamConfig
+		checks []healthCheck
+	}{
+		"url": {
+			spec:   UpstreamConfig{URL: "http://a:8080"},
+			checks: []healthCheck{{target: "http://a:8080", url: "http://a:8080"}},
+		},
+		"health check": {
+			spec:   UpstreamConfig{URL: "http://a:8080", HealthCheck: "http://a:8081/status"},
+			checks: []healthCheck{{target: "http://a:8080", url: "http://a:8081/status"}},
+		},
+		"multiple urls": {
+			spec: UpstreamConfig{URL: "http://a:8080", URLs: []string{"http://b:8080/app/", "http://a:8080"}, HealthCheck: "http://a:8080/login?x=1"},
+			checks: []healthCheck{
+				{target: "http://a:8080", url: "http://a:8080/login?x=1"},
+				{target: "http://b:8080/app/", url: "http://b:8080/login?x=1"},
+			},
+		},
+		"relative health check": {
+			spec: UpstreamConfig{URLs: []string{"http://a", "http://b"}, HealthCheck: "/healthz"},
+			checks: []healthCheck{
+				{target: "http://a", url: "http://a/healthz"},
+				{target: "http://b", url: "http://b/healthz"},
+			},
+		},
+		"routes": {
+			spec: UpstreamConfig{URL: "http://a", Routes: []RouteConfig{{Path: "/api", URL: "http://b", HealthCheck: "/ping"}}},
+			checks: []healthCheck{
+				{target: "http://b", url: "http://b/ping"},
+				{target: "http://a", url: "http://a"},
+			},
+		},
+		"websocket only": {
+			spec:   UpstreamConfig{WebSocket: "ws://a", HealthCheck: "http://a/status"},
+			checks: []healthCheck{{target: "http://a/status", url: "http://a/status"}},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.checks, test.spec.healthChecks())
+		})
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	ok := dummyBackend("ok")
+	defer ok.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusBadGateway)
+	}))
+	defer broken.Close()
+
+	s := &Server{Config: &Config{
+		Domain:    "example.com",
+		Upstreams: map[string]UpstreamConfig{"app": {URLs: []string{ok.URL, broken.URL}}},
+		Auth:      auth.Config{Type: "mock", Config: json.RawMessage(`{}`)},
+		TLS:       TLSConfig{CertFile: "fixtures/cert.pem", CertKey: "fixtures/key.pem"},
+	}}
+	require.NoError(t, s.Reload(s.Config))
+	s.current().performCheck()
+
+	rw := httptest.NewRecorder()
+	s.reloadable().ServeHTTP(rw, httptest.NewRequest("GET", "https://health.example.com/check", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+
+	var report struct {
+		Upstreams map[string]healthStatus
+	}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &report))
+	app := report.Upstreams["app"]
+	assert.Equal(t, "1/2 healthy", app.Response)
+	assert.Equal(t, "200 OK", app.Targets["0"].Response)
+	assert.Equal(t, "502 Bad Gateway", app.Targets["1"].Response)
+
+	// The servers' addresses aren't published.
+	assert.NotContains(t, rw.Body.String(), ok.URL)
+	assert.NotContains(t, rw.Body.String(), broken.URL)
+}
+
+func TestHealthChecks_Reload(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	other, err := os.ReadFile("fixtures/cert.pem")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(caFile, other, 0600))
+
+	config := func() *Config {
+		return &Config{
+			Domain:    "example.com",
+			Upstreams: map[string]UpstreamConfig{"app": {URL: backend.URL, TLS: &UpstreamTLSConfig{CAFile: caFile}}},
+			Auth:      auth.Config{Type: "mock", Config: json.RawMessage(`{}`)},
+			TLS:       TLSConfig{CertFile: "fixtures/cert.pem", CertKey: "fixtures/key.pem"},
+		}
+	}
+	s := &Server{Config: config()}
+	status := func() healthStatus {
+		current := s.current()
+		current.performCheck()
+		current.health.RLock()
+		defer current.health.RUnlock()
+		return current.health.upstreams["app"]
+	}
+
+	require.NoError(t, s.Reload(s.Config))
+	assert.False(t, status().ok)
+
+	// The CA file is read again when the config is reloaded.
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, ca, 0600))
+	require.NoError(t, s.Reload(config()))
+	assert.True(t, status().ok)
+}
@@ -0,0 +1,198 @@
+package sohop
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/davars/sohop/audit"
+	"github.com/davars/sohop/globals"
+	"github.com/gorilla/handlers"
+)
+
+// Log formats.
+const (
+	LogCombined = "combined"
+	LogJSON     = "json"
+	LogText     = "text"
+)
+
+// logger returns the logger for events described by c.
+func (c LogConfig) logger() (*slog.Logger, error) {
+	var level slog.Level
+	if c.Level != "" {
+		if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+			return nil, fmt.Errorf("unknown level %q", c.Level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch c.Format {
+	case "", LogCombined:
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case LogJSON:
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts)), nil
+	case LogText:
+		return slog.New(slog.NewTextHandler(os.Stdout, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", c.Format)
+	}
+}
+
+// logger returns the logger for events that aren't part of a request.
+func (s Server) logger() *slog.Logger {
+	if s.log == nil {
+		return slog.Default()
+	}
+	return s.log
+}
+
+// A statusRecorder records the status and size of the response written
+// through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 && code >= 200 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Hijack allows WebSocket connections to be proxied through the recorder.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil && r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying
+// ResponseWriter, so proxied responses can still be flushed.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// code returns the status of the response.
+func (r *statusRecorder) code() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// requestInfo collects details about a request for its access log line.
+type requestInfo struct {
+	upstream        string
+	upstreamLatency time.Duration
+
+	// user is the authenticated user, set once authentication (by session
+	// cookie, bearer credential or client certificate) has happened.
+	user string
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// setUser records the user r was authenticated as in its access log line.
+func setUser(r *http.Request, user string) {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.user = user
+	}
+}
+
+var requestIDRE = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// requestID returns the request's X-Request-ID, generating one if it isn't
+// set (or doesn't look like an ID).
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); requestIDRE.MatchString(id) {
+		return id
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// logging returns a middleware that assigns each request an ID, passed
+// upstream and returned in the X-Request-ID header, and writes the access log.
+// The request's context carries a logger that includes the ID (see
+// globals.Logger) and the audit log.
+func (s Server) logging(next http.Handler) http.Handler {
+	logger := s.logger()
+
+	if s.Config.Log.Format == "" || s.Config.Log.Format == LogCombined {
+		combined := handlers.CombinedLoggingHandler(os.Stdout, next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := requestID(r)
+			r.Header.Set("X-Request-ID", id)
+			w.Header().Set("X-Request-ID", id)
+			ctx := audit.NewContext(r.Context(), s.audit)
+			ctx = globals.WithLogger(ctx, logger.With("request_id", id))
+			combined.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		r.Header.Set("X-Request-ID", id)
+		w.Header().Set("X-Request-ID", id)
+
+		info := &requestInfo{}
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, info)
+		ctx = audit.NewContext(ctx, s.audit)
+		ctx = globals.WithLogger(ctx, logger.With("request_id", id))
+		r = r.WithContext(ctx)
+		uri := r.RequestURI
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		attrs := []slog.Attr{
+			slog.String("request_id", id),
+			slog.String("method", r.Method),
+			slog.String("host", r.Host),
+			slog.String("uri", uri),
+			slog.String("proto", r.Proto),
+			slog.Int("status", rec.code()),
+			slog.Int64("bytes", rec.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start))/float64(time.Millisecond)),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("user_agent", r.UserAgent()),
+			slog.String("referer", r.Referer()),
+			slog.String("user", info.user),
+		}
+		if info.upstream != "" {
+			attrs = append(attrs,
+				slog.String("upstream", info.upstream),
+				slog.Float64("upstream_ms", float64(info.upstreamLatency)/float64(time.Millisecond)))
+		}
+		logger.LogAttrs(ctx, slog.LevelInfo, "request", attrs...)
+	})
+}
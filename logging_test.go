@@ -0,0 +1,94 @@
+package sohop
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/davars/sohop/auth"
+	"github.com/davars/sohop/globals"
+	"github.com/davars/sohop/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogging(t *testing.T) {
+	store, err := state.New("test", "3c0767ada2466a92a59c1214061441713aeafe6d115e29aa376c0f9758cdf0f5", "example.com")
+	require.NoError(t, err)
+
+	key, hash, err := auth.NewAPIKey()
+	require.NoError(t, err)
+	bearer, err := auth.NewBearerAuth([]auth.APIKey{{Hash: hash, User: "deploy"}}, "", "example.com")
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	s := Server{
+		Config:      &Config{Domain: "example.com", Log: LogConfig{Format: LogJSON}},
+		storeConfig: store,
+		log:         slog.New(slog.NewJSONHandler(buf, nil)),
+	}
+	handler := s.logging(bearer.Middleware(s.authorizing(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestInfoFrom(r.Context()).upstream = "foo"
+		globals.Logger(r.Context()).Info("event", "forwarded_id", r.Header.Get("X-Request-ID"))
+		io.WriteString(w, "hello")
+	}))))
+
+	lines := func() []map[string]interface{} {
+		var entries []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			entry := map[string]interface{}{}
+			require.NoError(t, json.Unmarshal([]byte(line), &entry))
+			entries = append(entries, entry)
+		}
+		buf.Reset()
+		return entries
+	}
+
+	req := authorizedRequest(t, store, "https://foo.example.com/bar?baz=1", &state.Identity{User: "someone"})
+	req.RequestURI = "/bar?baz=1"
+	req.Header.Set("X-Request-ID", "abc-123")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, "abc-123", rw.Header().Get("X-Request-ID"))
+
+	entries := lines()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "event", entries[0]["msg"])
+	assert.Equal(t, "abc-123", entries[0]["request_id"])
+	assert.Equal(t, "abc-123", entries[0]["forwarded_id"])
+
+	access := entries[1]
+	assert.Equal(t, "request", access["msg"])
+	assert.Equal(t, "abc-123", access["request_id"])
+	assert.Equal(t, "GET", access["method"])
+	assert.Equal(t, "foo.example.com", access["host"])
+	assert.Equal(t, "/bar?baz=1", access["uri"])
+	assert.Equal(t, 200.0, access["status"])
+	assert.Equal(t, 5.0, access["bytes"])
+	assert.Equal(t, "someone", access["user"])
+	assert.Equal(t, "foo", access["upstream"])
+	assert.Contains(t, access, "duration_ms")
+	assert.Contains(t, access, "upstream_ms")
+
+	// IDs that don't look like IDs are replaced.
+	req = httptest.NewRequest("GET", "https://foo.example.com/", nil)
+	req.Header.Set("X-Request-ID", "<script>")
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	id := rw.Header().Get("X-Request-ID")
+	assert.Regexp(t, "^[0-9a-f]{16}$", id)
+	entries = lines()
+	assert.Equal(t, id, entries[1]["request_id"])
+	assert.Equal(t, "", entries[1]["user"])
+
+	// Users authenticated by other means than the session cookie are logged.
+	req = httptest.NewRequest("GET", "https://foo.example.com/", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "deploy", lines()[1]["user"])
+}
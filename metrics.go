@@ -0,0 +1,58 @@
+package sohop
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	upstreamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sohop_upstream_requests_total",
+		Help: "Requests proxied to each upstream, by status class (2xx, 3xx etc.).",
+	}, []string{"upstream", "code"})
+
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sohop_upstream_request_duration_seconds",
+		Help:    "Time taken to proxy requests to each upstream.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"upstream"})
+
+	websocketConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sohop_upstream_websocket_connections",
+		Help: "WebSocket connections currently proxied to each upstream.",
+	}, []string{"upstream"})
+
+	upstreamUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sohop_upstream_up",
+		Help: "Whether each upstream server (by index) passed its last health check.",
+	}, []string{"upstream", "target"})
+
+	upstreamCheckDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sohop_upstream_check_duration_seconds",
+		Help: "Time taken by the last health check of each upstream server (by index).",
+	}, []string{"upstream", "target"})
+
+	certExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sohop_cert_expiry_timestamp_seconds",
+		Help: "When the TLS certificate expires, as a Unix timestamp.",
+	})
+)
+
+// observe serves r with next, recording the request's status and duration
+// in the metrics for upstream.
+func observe(upstream string, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	next.ServeHTTP(rec, r)
+	elapsed := time.Since(start)
+
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.upstreamLatency = elapsed
+	}
+	upstreamRequests.WithLabelValues(upstream, fmt.Sprintf("%dxx", rec.code()/100)).Inc()
+	upstreamDuration.WithLabelValues(upstream).Observe(elapsed.Seconds())
+}
@@ -0,0 +1,69 @@
+package sohop
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/davars/sohop/auth"
+	"github.com/davars/sohop/state"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	ok := dummyBackend("ok")
+	defer ok.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusBadGateway)
+	}))
+	defer broken.Close()
+
+	s := &Server{Config: &Config{
+		Domain: "example.com",
+		Upstreams: map[string]UpstreamConfig{
+			"metricsok":     {URL: ok.URL},
+			"metricsbroken": {URL: broken.URL},
+		},
+		Auth:  auth.Config{Type: "mock", Config: json.RawMessage(`{}`)},
+		TLS:   TLSConfig{CertFile: "fixtures/cert.pem", CertKey: "fixtures/key.pem"},
+		Admin: &AdminConfig{Policy: &Policy{Users: []string{"root"}}},
+	}}
+	require.NoError(t, s.Reload(s.Config))
+	live := s.reloadable()
+
+	okRequests := upstreamRequests.WithLabelValues("metricsok", "2xx")
+	brokenRequests := upstreamRequests.WithLabelValues("metricsbroken", "5xx")
+	okBefore, brokenBefore := testutil.ToFloat64(okRequests), testutil.ToFloat64(brokenRequests)
+
+	for _, host := range []string{"metricsok", "metricsok", "metricsbroken"} {
+		live.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "https://"+host+".example.com/", nil))
+	}
+	assert.Equal(t, okBefore+2, testutil.ToFloat64(okRequests))
+	assert.Equal(t, brokenBefore+1, testutil.ToFloat64(brokenRequests))
+
+	s.current().performCheck()
+	assert.Equal(t, 1.0, testutil.ToFloat64(upstreamUp.WithLabelValues("metricsok", "0")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(upstreamUp.WithLabelValues("metricsbroken", "0")))
+	assert.NotZero(t, testutil.ToFloat64(certExpiry))
+
+	// Metrics are only available to admins.
+	store, err := s.current().Config.storeConfig(nil)
+	require.NoError(t, err)
+	metrics := func(req *http.Request) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		live.ServeHTTP(rw, req)
+		return rw
+	}
+	assert.NotContains(t, metrics(httptest.NewRequest("GET", "https://health.example.com/metrics", nil)).Body.String(), "sohop_")
+	assert.Equal(t, http.StatusFound, metrics(httptest.NewRequest("GET", "https://admin.example.com/metrics", nil)).Code)
+	assert.Equal(t, http.StatusForbidden, metrics(authorizedRequest(t, store, "https://admin.example.com/metrics", &state.Identity{User: "guest"})).Code)
+
+	rw := metrics(authorizedRequest(t, store, "https://admin.example.com/metrics", &state.Identity{User: "root"}))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), `sohop_upstream_requests_total{code="2xx",upstream="metricsok"}`)
+	assert.Contains(t, rw.Body.String(), `sohop_upstream_up{target="0",upstream="metricsbroken"} 0`)
+	assert.NotContains(t, rw.Body.String(), broken.URL)
+}
@@ -1,16 +1,40 @@
 package sohop
 
 import (
+	"html/template"
 	"net/http"
-	"os"
-
-	"github.com/gorilla/handlers"
 )
 
 func notFound(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "not found", http.StatusNotFound)
 }
 
-func logging(next http.Handler) http.Handler {
-	return handlers.CombinedLoggingHandler(os.Stdout, next)
+var forbiddenTemplate = template.Must(template.New("forbidden").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Access denied</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; background: #f6f8fa; color: #24292e; margin: 0; }
+main { max-width: 32em; margin: 15vh auto; padding: 2em; background: #fff; border: 1px solid #e1e4e8; border-radius: 6px; }
+h1 { font-size: 1.5em; margin-top: 0; }
+code { background: #f6f8fa; padding: 0.1em 0.3em; border-radius: 3px; }
+</style>
+</head>
+<body>
+<main>
+<h1>Access denied</h1>
+<p>{{if .User}}You are signed in as <code>{{.User}}</code>, but you{{else}}You{{end}} don't have access to <code>{{.Host}}</code>.</p>
+<p>Contact your administrator if you think this is a mistake.</p>
+</main>
+</body>
+</html>
+`))
+
+// forbidden renders a styled http.StatusForbidden page for user.
+func forbidden(w http.ResponseWriter, r *http.Request, user string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	forbiddenTemplate.Execute(w, struct{ User, Host string }{User: user, Host: r.Host})
 }
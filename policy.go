@@ -0,0 +1,129 @@
+package sohop
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/davars/sohop/audit"
+	"github.com/davars/sohop/auth"
+	"github.com/davars/sohop/globals"
+	"github.com/davars/sohop/state"
+	"github.com/gorilla/mux"
+)
+
+// A Policy restricts which authenticated users may access an upstream.  A user
+// is allowed if they match any of the listed users, groups or email domains.
+type Policy struct {
+	// Users lists the users (as identified by the auther, e.g. a Github login
+	// or an email address) that are allowed.
+	Users []string
+
+	// Groups lists the groups whose members are allowed, e.g. OpenID Connect
+	// groups or Github orgs and teams (as "org/team-slug").
+	Groups []string
+
+	// EmailDomains lists the email domains whose users are allowed.
+	EmailDomains []string
+}
+
+// allows returns nil if the identity satisfies the policy, or an error
+// describing why it doesn't.
+func (p *Policy) allows(user, email string, groups []string) error {
+	if p == nil {
+		return nil
+	}
+
+	for _, u := range p.Users {
+		if strings.EqualFold(u, user) {
+			return nil
+		}
+	}
+
+	for _, g := range p.Groups {
+		for _, have := range groups {
+			if g == have {
+				return nil
+			}
+		}
+	}
+
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		domain := email[at+1:]
+		for _, d := range p.EmailDomains {
+			if strings.EqualFold(d, domain) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("%q does not match any allowed user, group or email domain", user)
+}
+
+// validatePolicy reports a Policy that lists no users, groups or email
+// domains, and so would deny everyone.
+func validatePolicy(path string, p *Policy, add func(string, error)) {
+	if p != nil && len(p.Users) == 0 && len(p.Groups) == 0 && len(p.EmailDomains) == 0 {
+		add(path, errors.New("matches no one"))
+	}
+}
+
+// authorizing returns a middleware that enforces the Policy of the upstream
+// selected by the request's subdomain, and records the user in the access
+// log.  It must run after authentication.
+func (s Server) authorizing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := s.storeConfig.GetSession(r)
+		setUser(r, session.User)
+		subdomain := mux.Vars(r)["subdomain"]
+		if upstream, ok := s.Config.Upstreams[subdomain]; ok {
+			if err := upstream.Policy.allows(session.User, session.Email, session.Groups); err != nil {
+				denied(w, r, subdomain, session.User, "https://"+r.Host+r.RequestURI, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maxAge returns a middleware that applies the SessionMaxAge of the upstream
+// selected by the request's subdomain.  It must run before authentication.
+func (s Server) maxAge(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subdomain := mux.Vars(r)["subdomain"]
+		if upstream, ok := s.Config.Upstreams[subdomain]; ok && upstream.SessionMaxAge > 0 {
+			r = state.WithMaxAge(r, time.Duration(upstream.SessionMaxAge))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientCerts returns a middleware that authenticates requests to upstreams
+// with ClientCert set using certs.
+func (s Server) clientCerts(certs *auth.CertAuth, next http.Handler) http.Handler {
+	authenticated := certs.Middleware(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upstream, ok := s.Config.Upstreams[mux.Vars(r)["subdomain"]]; ok && upstream.ClientCert {
+			authenticated.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// denied responds with a 403 to a request from user to url, which the Policy
+// of upstream doesn't allow, and records the decision.
+func denied(w http.ResponseWriter, r *http.Request, upstream, user, url string, err error) {
+	globals.Logger(r.Context()).Warn("policy denied access", "upstream", upstream, "user", user, "error", err)
+	audit.Record(r, audit.Event{
+		Event:    audit.AccessDenied,
+		Reason:   "policy",
+		Error:    err.Error(),
+		User:     user,
+		Upstream: upstream,
+		URL:      url,
+	})
+	forbidden(w, r, user)
+}
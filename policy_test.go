@@ -0,0 +1,194 @@
+package sohop
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	realclock "code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/clock/fakeclock"
+	"github.com/davars/sohop/audit"
+	"github.com/davars/sohop/globals"
+	"github.com/davars/sohop/state"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_allows(t *testing.T) {
+	policy := &Policy{
+		Users:        []string{"octocat"},
+		Groups:       []string{"admins"},
+		EmailDomains: []string{"example.com"},
+	}
+
+	tests := map[string]struct {
+		policy *Policy
+		user   string
+		email  string
+		groups []string
+		err    string
+	}{
+		"no policy": {
+			user: "anyone",
+		},
+		"user": {
+			policy: policy,
+			user:   "OctoCat",
+		},
+		"group": {
+			policy: policy,
+			user:   "someone",
+			groups: []string{"staff", "admins"},
+		},
+		"email domain": {
+			policy: policy,
+			user:   "someone@example.com",
+			email:  "someone@example.com",
+		},
+		"denied": {
+			policy: policy,
+			user:   "someone@example.org",
+			email:  "someone@example.org",
+			groups: []string{"staff"},
+			err:    `"someone@example.org" does not match any allowed user, group or email domain`,
+		},
+		"empty policy": {
+			policy: &Policy{},
+			user:   "someone",
+			err:    `"someone" does not match any allowed user, group or email domain`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := test.policy.allows(test.user, test.email, test.groups)
+			if test.err == "" {
+				assert.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Equal(t, test.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestAuthorizing(t *testing.T) {
+	store, err := state.New("test", "3c0767ada2466a92a59c1214061441713aeafe6d115e29aa376c0f9758cdf0f5", "example.com")
+	require.NoError(t, err)
+
+	s := Server{
+		Config: &Config{
+			Domain: "example.com",
+			Upstreams: map[string]UpstreamConfig{
+				"admin": {Policy: &Policy{Users: []string{"root"}, Groups: []string{"acme/ops"}}},
+				"open":  {Auth: true},
+			},
+		},
+		storeConfig: store,
+	}
+	handler := s.authorizing(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		subdomain string
+		user      string
+		groups    []string
+		status    int
+	}{
+		{subdomain: "admin", user: "root", status: http.StatusNoContent},
+		{subdomain: "admin", user: "operator", groups: []string{"acme", "acme/ops"}, status: http.StatusNoContent},
+		{subdomain: "admin", user: "guest", status: http.StatusForbidden},
+		{subdomain: "open", user: "guest", status: http.StatusNoContent},
+	}
+
+	for _, test := range tests {
+		t.Run(test.subdomain+"/"+test.user, func(t *testing.T) {
+			req := authorizedRequest(t, store, "https://"+test.subdomain+".example.com/", &state.Identity{User: test.user, Groups: test.groups})
+			req = mux.SetURLVars(req, map[string]string{"subdomain": test.subdomain})
+			buf := &bytes.Buffer{}
+			req = req.WithContext(audit.NewContext(req.Context(), audit.New(buf)))
+
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			assert.Equal(t, test.status, rw.Code)
+			if test.status == http.StatusForbidden {
+				assert.Contains(t, rw.Body.String(), "You are signed in as <code>"+test.user+"</code>")
+
+				var event audit.Event
+				require.NoError(t, json.Unmarshal(buf.Bytes(), &event))
+				assert.Equal(t, audit.AccessDenied, event.Event)
+				assert.Equal(t, test.user, event.User)
+				assert.Equal(t, test.subdomain, event.Upstream)
+			} else {
+				assert.Empty(t, buf.String())
+			}
+		})
+	}
+}
+
+// authorizedRequest returns a request to url carrying the session cookie for
+// id.  If id is nil the request has no session cookie.
+func authorizedRequest(t *testing.T, store state.Store, url string, id *state.Identity) *http.Request {
+	req := httptest.NewRequest("GET", url, nil)
+	if id == nil {
+		return req
+	}
+
+	rw := httptest.NewRecorder()
+	require.NoError(t, store.Authorize(rw, req, id))
+	req = httptest.NewRequest("GET", url, nil)
+	for _, cookie := range rw.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func TestMaxAge(t *testing.T) {
+	start := time.Now()
+	clock := fakeclock.NewFakeClock(start)
+	globals.Clock = clock
+	defer func() { globals.Clock = realclock.NewClock() }()
+
+	store, err := state.New("test", "3c0767ada2466a92a59c1214061441713aeafe6d115e29aa376c0f9758cdf0f5", "example.com")
+	require.NoError(t, err)
+
+	s := Server{
+		Config: &Config{
+			Domain: "example.com",
+			Upstreams: map[string]UpstreamConfig{
+				"strict": {SessionMaxAge: Duration(time.Hour)},
+				"open":   {Auth: true},
+			},
+		},
+		storeConfig: store,
+	}
+	handler := s.maxAge(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !store.IsAuthorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	login := authorizedRequest(t, store, "https://example.com/", &state.Identity{User: "user"})
+	clock.Increment(2 * time.Hour)
+
+	for subdomain, status := range map[string]int{"strict": http.StatusUnauthorized, "open": http.StatusNoContent} {
+		t.Run(subdomain, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "https://"+subdomain+".example.com/", nil)
+			for _, cookie := range login.Cookies() {
+				req.AddCookie(cookie)
+			}
+			req = mux.SetURLVars(req, map[string]string{"subdomain": subdomain})
+
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			assert.Equal(t, status, rw.Code)
+		})
+	}
+}
@@ -1,60 +1,231 @@
 package sohop
 
 import (
-	"bytes"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"sort"
 	"strings"
-	"text/template"
+	"time"
 
+	"github.com/davars/sohop/state"
 	"github.com/gorilla/mux"
 	"github.com/yhat/wsutil"
 )
 
-type headerTemplate map[string][]*template.Template
-
 type upstream struct {
-	HTTPProxy       *httputil.ReverseProxy
-	WSProxy         *wsutil.ReverseProxy
+	// routes are sorted by descending prefix length, so the first match is
+	// the most specific.
+	routes          []route
 	headerTemplates headerTemplate
+
+	// responseTemplates and removeResponseHeaders are applied to the
+	// upstream's responses, and removeHeaders to requests.
+	responseTemplates     headerTemplate
+	removeHeaders         []string
+	removeResponseHeaders []string
+
+	// assertion configures the identity assertion sent to the upstream, if
+	// any, and audience is its "aud" claim.
+	assertion *UpstreamAssertionConfig
+	audience  string
+}
+
+// A route proxies requests whose path starts with prefix.
+type route struct {
+	prefix      string
+	stripPrefix bool
+	addPrefix   string
+	HTTPProxy   *pool
+	WSProxy     *wsutil.ReverseProxy
+}
+
+// matches returns true if p is prefix, or is below it in the path hierarchy.
+func (rt route) matches(p string) bool {
+	if rt.prefix == "/" || p == rt.prefix {
+		return true
+	}
+	return strings.HasPrefix(p, strings.TrimSuffix(rt.prefix, "/")+"/")
+}
+
+// rewrite applies the route's prefix stripping and adding to p.
+func (rt route) rewrite(p string) string {
+	if p == "" {
+		return p
+	}
+	if rt.stripPrefix && rt.prefix != "/" {
+		p = strings.TrimPrefix(p, strings.TrimSuffix(rt.prefix, "/"))
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+	}
+	if rt.addPrefix != "" {
+		p = strings.TrimSuffix(rt.addPrefix, "/") + p
+	}
+	return p
+}
+
+// needsSession reports whether the user's session is needed to build the
+// request to the upstream or its response.
+func (u upstream) needsSession() bool {
+	return len(u.headerTemplates) > 0 || len(u.responseTemplates) > 0 || u.assertion != nil
+}
+
+// route returns the route for path p, or false if there isn't one.
+func (u upstream) route(p string) (route, bool) {
+	for _, rt := range u.routes {
+		if rt.matches(p) {
+			return rt, true
+		}
+	}
+	return route{}, false
+}
+
+// newRoute creates the proxies for a route.
+func newRoute(spec RouteConfig, transport http.RoundTripper, tlsConfig *tls.Config, health *healthReport) (route, error) {
+	rt := route{prefix: spec.Path, stripPrefix: spec.StripPrefix, addPrefix: spec.AddPrefix}
+	if rt.prefix == "" {
+		rt.prefix = "/"
+	}
+	if !strings.HasPrefix(rt.prefix, "/") {
+		return route{}, fmt.Errorf("route path %q must start with /", spec.Path)
+	}
+
+	if urls := spec.urls(); len(urls) > 0 {
+		p, err := newPool(urls, spec.Balance, transport, health)
+		if err != nil {
+			return route{}, err
+		}
+		rt.HTTPProxy = p
+	}
+
+	if spec.WebSocket != "" {
+		target, err := url.Parse(spec.WebSocket)
+		if err != nil {
+			return route{}, err
+		}
+		rt.WSProxy = wsutil.NewSingleHostReverseProxy(target)
+		rt.WSProxy.TLSClientConfig = tlsConfig
+	}
+	return rt, nil
+}
+
+// urls returns the route's URL and URLs, without duplicates.
+func (spec RouteConfig) urls() []string {
+	var urls []string
+	seen := map[string]bool{}
+	for _, u := range append([]string{spec.URL}, spec.URLs...) {
+		if u != "" && !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// routeConfigs returns the routes of an upstream, including the default route
+// for its URL(s) and WebSocket (unless a route for "/" is configured).
+func (spec UpstreamConfig) routeConfigs() []RouteConfig {
+	routes := append([]RouteConfig{}, spec.Routes...)
+	for _, rt := range routes {
+		if rt.Path == "" || rt.Path == "/" {
+			return routes
+		}
+	}
+	if spec.URL != "" || len(spec.URLs) > 0 || spec.WebSocket != "" {
+		routes = append(routes, RouteConfig{
+			Path:        "/",
+			URL:         spec.URL,
+			URLs:        spec.URLs,
+			Balance:     spec.Balance,
+			WebSocket:   spec.WebSocket,
+			HealthCheck: spec.HealthCheck,
+		})
+	}
+	return routes
 }
 
-func (c *Config) createUpstreams() (map[string]upstream, error) {
-	// Assume upstreams are accessible via trusted network
-	tlsConfig := &tls.Config{InsecureSkipVerify: true} // codeql[go/disabled-certificate-check]
-	transport := &http.Transport{TLSClientConfig: tlsConfig}
+// tlsConfig returns the client TLS configuration for an upstream's servers.
+func (c *UpstreamTLSConfig) tlsConfig() (*tls.Config, error) {
+	if c == nil {
+		// Assume upstreams are accessible via trusted network
+		return &tls.Config{InsecureSkipVerify: true}, nil // codeql[go/disabled-certificate-check]
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: !c.Verify && c.CAFile == "", // codeql[go/disabled-certificate-check]
+		ServerName:         c.ServerName,
+	}
+
+	if c.CAFile != "" {
+		data, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// createUpstreams creates the proxies for each upstream.  Targets that health
+// reports as unhealthy are skipped when balancing requests; health may be nil.
+func (c *Config) createUpstreams(health *healthReport) (map[string]upstream, error) {
 	m := map[string]upstream{}
 
 	for name, spec := range c.Upstreams {
 		upstream := upstream{}
 
-		if spec.URL != "" {
-			target, err := url.Parse(spec.URL)
-			if err != nil {
-				return nil, err
-			}
-			upstream.HTTPProxy = httputil.NewSingleHostReverseProxy(target)
-			upstream.HTTPProxy.Transport = transport
+		tlsConfig, err := spec.TLS.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %v", name, err)
 		}
+		transport := &http.Transport{TLSClientConfig: tlsConfig}
 
-		if spec.WebSocket != "" {
-			target, err := url.Parse(spec.WebSocket)
+		for _, routeSpec := range spec.routeConfigs() {
+			rt, err := newRoute(routeSpec, transport, tlsConfig, health)
 			if err != nil {
 				return nil, err
 			}
-			upstream.WSProxy = wsutil.NewSingleHostReverseProxy(target)
-			upstream.WSProxy.TLSClientConfig = tlsConfig
-		}
-		templates := make(headerTemplate, len(spec.Headers))
-		for k, v := range spec.Headers {
-			for _, t := range v {
-				template := template.Must(template.New("").Parse(t))
-				templates[k] = append(templates[k], template)
+			upstream.routes = append(upstream.routes, rt)
+		}
+		sort.SliceStable(upstream.routes, func(i, j int) bool {
+			return len(upstream.routes[i].prefix) > len(upstream.routes[j].prefix)
+		})
+
+		upstream.headerTemplates, err = newHeaderTemplate(spec.Headers)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %v", name, err)
+		}
+		upstream.responseTemplates, err = newHeaderTemplate(spec.ResponseHeaders)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: response %v", name, err)
+		}
+		upstream.removeHeaders = spec.RemoveHeaders
+		upstream.removeResponseHeaders = spec.RemoveResponseHeaders
+
+		if spec.Assertion != nil {
+			upstream.assertion = spec.Assertion
+			upstream.audience = spec.Assertion.Audience
+			if upstream.audience == "" {
+				upstream.audience = fmt.Sprintf("https://%s.%s", name, c.Domain)
 			}
 		}
-		upstream.headerTemplates = templates
 
 		m[name] = upstream
 	}
@@ -62,19 +233,110 @@ func (c *Config) createUpstreams() (map[string]upstream, error) {
 	return m, nil
 }
 
+// Session is the view of the user's session available to header templates.
 type Session struct {
+	// Values maps "user", "email" and "name" to the corresponding fields.
+	// Kept for compatibility with templates written before the other fields
+	// were added.
 	Values map[string]string
+
+	User   string
+	Email  string
+	Name   string
+	Groups []string
+
+	// Claims holds any other values reported by the auth provider.
+	Claims map[string]string
+
+	// AuthenticatedAt is when the user logged in, and ExpiresAt when the
+	// session expires.  Both are zero if the user isn't logged in.
+	AuthenticatedAt time.Time
+	ExpiresAt       time.Time
+}
+
+// Request is the view of the incoming request available to header templates.
+type Request struct {
+	Method string
+	Host   string
+
+	// Path and Query are the request's path (before any route rewrites it)
+	// and raw query string.
+	Path  string
+	Query string
+
+	// RemoteIP is the address of the client, as reported by a trusted proxy
+	// if there is one (see Config.TrustedProxies).
+	RemoteIP string
+
+	// Header holds the request's headers as sent by the client.
+	Header http.Header
 }
 
+// TemplateData is the data header templates are evaluated with.
 type TemplateData struct {
-	Session struct{ Values map[string]string }
+	Session Session
+	Request Request
+
+	// Upstream is the name (subdomain) of the upstream.
+	Upstream string
+}
+
+func newRequest(r *http.Request) Request {
+	return Request{
+		Method:   r.Method,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		Query:    r.URL.RawQuery,
+		RemoteIP: remoteIP(r),
+		Header:   r.Header.Clone(),
+	}
+}
+
+// remoteIP returns the address of the client making r.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func newSession(session *state.Session) Session {
+	view := Session{
+		Values: map[string]string{
+			"user":  session.User,
+			"email": session.Email,
+			"name":  session.Name,
+		},
+		User:   session.User,
+		Email:  session.Email,
+		Name:   session.Name,
+		Groups: session.Groups,
+		Claims: session.Claims,
+	}
+	if session.AuthenticatedAt != nil {
+		view.AuthenticatedAt = session.AuthenticatedAt.AsTime()
+	}
+	if session.ExpiresAt != nil {
+		view.ExpiresAt = session.ExpiresAt.AsTime()
+	}
+	return view
 }
 
 // ProxyHandler selects the appropriate upstream based on subdomain of the
 // incoming request and does the proxying.
-func (s Server) ProxyHandler() http.Handler {
-	upstreams, err := s.Config.createUpstreams()
-	check(err)
+func (s Server) ProxyHandler() (http.Handler, error) {
+	upstreams, err := s.Config.createUpstreams(s.health)
+	if err != nil {
+		return nil, err
+	}
+	assertions := s.assertions
+	if assertions == nil {
+		if assertions, err = s.Config.assertionKeys(nil); err != nil {
+			return nil, err
+		}
+	}
+	issuer := s.Config.assertionIssuer()
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		subdomain := mux.Vars(r)["subdomain"]
@@ -83,26 +345,63 @@ func (s Server) ProxyHandler() http.Handler {
 			notFound(w, r)
 			return
 		}
+		if info := requestInfoFrom(r.Context()); info != nil {
+			info.upstream = subdomain
+		}
+
+		route, ok := upstream.route(r.URL.Path)
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		f := forwardedFrom(r.Context())
+		if f == nil {
+			r, f = withForwarded(r, nil)
+		}
 
-		if len(upstream.headerTemplates) > 0 {
-			for k, vs := range upstream.headerTemplates {
-				r.Header.Del(k)
-				session := s.storeConfig.GetSession(r)
-				for _, v := range vs {
-					buf := &bytes.Buffer{}
-					err := v.Execute(buf, TemplateData{
-						Session: Session{Values: map[string]string{"user": session.User}},
-					})
-					if err != nil {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-					r.Header.Add(k, buf.String())
+		var data *TemplateData
+		var session *state.Session
+		if upstream.needsSession() {
+			session = s.storeConfig.GetSession(r)
+			setUser(r, session.User)
+			data = &TemplateData{Session: newSession(session), Request: newRequest(r), Upstream: subdomain}
+		}
+
+		f.setHeaders(r.Header)
+
+		r.URL.Path = route.rewrite(r.URL.Path)
+		r.URL.RawPath = route.rewrite(r.URL.RawPath)
+
+		for _, k := range upstream.removeHeaders {
+			r.Header.Del(k)
+		}
+		if err := upstream.headerTemplates.apply(r.Header, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(upstream.responseTemplates) > 0 || len(upstream.removeResponseHeaders) > 0 {
+			set := http.Header{}
+			if err := upstream.responseTemplates.apply(set, data); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w = &headerWriter{ResponseWriter: w, remove: upstream.removeResponseHeaders, set: set}
+		}
+
+		if upstream.assertion != nil {
+			header := upstream.assertion.header()
+			r.Header.Del(header)
+			if session.User != "" {
+				assertion, err := assertions.sign(issuer, upstream.audience, upstream.assertion.ttl(), session)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
 				}
+				r.Header.Set(header, assertion)
 			}
 		}
 
-		if upstream.WSProxy != nil && wsutil.IsWebSocketRequest(r) {
+		if route.WSProxy != nil && wsutil.IsWebSocketRequest(r) {
 			// HACK: EdgeOS treats headers as case-sensitive.  Bypass canonicalization.
 			for k, v := range r.Header {
 				if strings.Contains(k, "Websocket") {
@@ -112,24 +411,31 @@ func (s Server) ProxyHandler() http.Handler {
 				}
 			}
 
-			upstream.WSProxy.ServeHTTP(w, r)
+			websocketConnections.WithLabelValues(subdomain).Inc()
+			defer websocketConnections.WithLabelValues(subdomain).Dec()
+			route.WSProxy.ServeHTTP(w, r)
 			return
 		}
 
-		if upstream.HTTPProxy != nil {
-			upstream.HTTPProxy.ServeHTTP(w, r)
+		if route.HTTPProxy != nil {
+			observe(subdomain, route.HTTPProxy, w, r)
 			return
 		}
 
 		notFound(w, r)
-	})
+	}), nil
+}
+
+// requiresAuth reports whether requests to the upstream must be authenticated.
+func (spec UpstreamConfig) requiresAuth() bool {
+	return spec.Auth || spec.Policy != nil || spec.SessionMaxAge > 0 || spec.ClientCert
 }
 
 func requiresAuth(c *Config) mux.MatcherFunc {
 	return func(r *http.Request, rm *mux.RouteMatch) bool {
 		subdomain := strings.Split(r.Host, ".")[0]
 		if upstream, ok := c.Upstreams[subdomain]; ok {
-			return upstream.Auth
+			return upstream.requiresAuth()
 		}
 
 		return true
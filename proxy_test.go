@@ -1,11 +1,14 @@
 package sohop
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/pem"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"testing"
 
 	"time"
@@ -13,6 +16,7 @@ import (
 	"encoding/json"
 
 	"github.com/davars/sohop/auth"
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/require"
 )
 
@@ -48,7 +52,9 @@ func TestProxy(t *testing.T) {
 		HTTPAddr:  "127.0.0.1:42080",
 		HTTPSAddr: "127.0.0.1:42443",
 	}
-	go sohop.Run()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sohop.Run(ctx)
 	time.Sleep(time.Second)
 
 	req, err := http.NewRequest("GET", "https://127.0.0.1:42443", nil)
@@ -66,3 +72,180 @@ func TestProxy(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, upstreamName, string(b))
 }
+
+func TestRoute(t *testing.T) {
+	tests := []struct {
+		route   route
+		path    string
+		matches bool
+		rewrite string
+	}{
+		{route: route{prefix: "/"}, path: "/foo", matches: true, rewrite: "/foo"},
+		{route: route{prefix: "/api"}, path: "/api", matches: true, rewrite: "/api"},
+		{route: route{prefix: "/api"}, path: "/api/users", matches: true, rewrite: "/api/users"},
+		{route: route{prefix: "/api/"}, path: "/api/users", matches: true, rewrite: "/api/users"},
+		{route: route{prefix: "/api"}, path: "/apiary", matches: false},
+		{route: route{prefix: "/api", stripPrefix: true}, path: "/api/users", matches: true, rewrite: "/users"},
+		{route: route{prefix: "/api", stripPrefix: true}, path: "/api", matches: true, rewrite: "/"},
+		{route: route{prefix: "/api/", stripPrefix: true}, path: "/api/users", matches: true, rewrite: "/users"},
+		{route: route{prefix: "/api", addPrefix: "/v1"}, path: "/api/users", matches: true, rewrite: "/v1/api/users"},
+		{route: route{prefix: "/api", stripPrefix: true, addPrefix: "/v2/"}, path: "/api/users", matches: true, rewrite: "/v2/users"},
+		{route: route{prefix: "/", stripPrefix: true, addPrefix: "/app"}, path: "/users", matches: true, rewrite: "/app/users"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.route.prefix+" "+test.path, func(t *testing.T) {
+			require.Equal(t, test.matches, test.route.matches(test.path))
+			if test.matches {
+				require.Equal(t, test.rewrite, test.route.rewrite(test.path))
+			}
+		})
+	}
+}
+
+func TestProxyHandler_Routes(t *testing.T) {
+	echo := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.URL.Path)
+		}))
+	}
+	api := echo("api")
+	defer api.Close()
+	web := echo("web")
+	defer web.Close()
+	docs := echo("docs")
+	defer docs.Close()
+
+	s := Server{Config: &Config{
+		Domain: "example.com",
+		Upstreams: map[string]UpstreamConfig{
+			"app": {
+				URL: web.URL,
+				Routes: []RouteConfig{
+					{Path: "/api", URL: api.URL, StripPrefix: true},
+					{Path: "/api/docs", URL: docs.URL, StripPrefix: true, AddPrefix: "/static"},
+				},
+			},
+			"apionly": {
+				Routes: []RouteConfig{{Path: "/api", URL: api.URL}},
+			},
+		},
+	}}
+	handler, err := s.ProxyHandler()
+	require.NoError(t, err)
+
+	tests := []struct {
+		subdomain string
+		path      string
+		status    int
+		body      string
+	}{
+		{subdomain: "app", path: "/", status: http.StatusOK, body: "web /"},
+		{subdomain: "app", path: "/apiary", status: http.StatusOK, body: "web /apiary"},
+		{subdomain: "app", path: "/api/users", status: http.StatusOK, body: "api /users"},
+		{subdomain: "app", path: "/api/docs/index.html", status: http.StatusOK, body: "docs /static/index.html"},
+		{subdomain: "apionly", path: "/api/users", status: http.StatusOK, body: "api /api/users"},
+		{subdomain: "apionly", path: "/", status: http.StatusNotFound, body: "not found\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.subdomain+test.path, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "https://"+test.subdomain+".example.com"+test.path, nil)
+			req = mux.SetURLVars(req, map[string]string{"subdomain": test.subdomain})
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			require.Equal(t, test.status, rw.Code)
+			require.Equal(t, test.body, rw.Body.String())
+		})
+	}
+}
+
+func TestProxyHandler_UpstreamTLS(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			io.WriteString(w, "client "+r.TLS.PeerCertificates[0].Subject.CommonName)
+			return
+		}
+		io.WriteString(w, "anonymous")
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	backend.StartTLS()
+	defer backend.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}), 0600))
+	clientCert, err := parseCert(mustReadFile(t, "fixtures/cert.pem"))
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		tls    *UpstreamTLSConfig
+		status int
+		body   string
+	}{
+		"default": {
+			status: http.StatusOK,
+			body:   "anonymous",
+		},
+		"verify with system roots": {
+			tls:    &UpstreamTLSConfig{Verify: true},
+			status: http.StatusBadGateway,
+		},
+		"verify with CA": {
+			tls:    &UpstreamTLSConfig{CAFile: caFile},
+			status: http.StatusOK,
+			body:   "anonymous",
+		},
+		"server name": {
+			tls:    &UpstreamTLSConfig{CAFile: caFile, ServerName: "example.com"},
+			status: http.StatusOK,
+			body:   "anonymous",
+		},
+		"wrong server name": {
+			tls:    &UpstreamTLSConfig{CAFile: caFile, ServerName: "other.org"},
+			status: http.StatusBadGateway,
+		},
+		"client certificate": {
+			tls:    &UpstreamTLSConfig{CAFile: caFile, CertFile: "fixtures/cert.pem", KeyFile: "fixtures/key.pem"},
+			status: http.StatusOK,
+			body:   "client " + clientCert.Subject.CommonName,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := Server{Config: &Config{
+				Domain: "example.com",
+				Upstreams: map[string]UpstreamConfig{
+					"app": {URL: backend.URL, TLS: test.tls},
+				},
+			}}
+			req := httptest.NewRequest("GET", "https://app.example.com/", nil)
+			req = mux.SetURLVars(req, map[string]string{"subdomain": "app"})
+			rw := httptest.NewRecorder()
+			handler, err := s.ProxyHandler()
+			require.NoError(t, err)
+			handler.ServeHTTP(rw, req)
+			require.Equal(t, test.status, rw.Code)
+			if test.body != "" {
+				require.Equal(t, test.body, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestUpstreamTLSConfig_Errors(t *testing.T) {
+	_, err := (&UpstreamTLSConfig{CAFile: "fixtures/missing.pem"}).tlsConfig()
+	require.Error(t, err)
+
+	_, err = (&UpstreamTLSConfig{CAFile: "fixtures/config.json"}).tlsConfig()
+	require.EqualError(t, err, "no certificates found in fixtures/config.json")
+
+	_, err = (&UpstreamTLSConfig{CertFile: "fixtures/cert.pem"}).tlsConfig()
+	require.Error(t, err)
+}
+
+func mustReadFile(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	return data
+}
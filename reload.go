@@ -0,0 +1,217 @@
+package sohop
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/davars/sohop/audit"
+	"github.com/davars/sohop/state"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// liveLock guards the creation of Server.live.
+var liveLock sync.Mutex
+
+// A reloadable holds the state of a running Server, including the parts that
+// Reload replaces.  It serves requests using the handler built from the
+// current configuration.
+type reloadable struct {
+	sync.RWMutex
+	config  *Config
+	handler http.Handler
+	health  *healthReport
+	log     *slog.Logger
+	audit   *audit.Log
+
+	// healthClients are the clients used to check the health of each
+	// upstream.
+	healthClients map[string]*http.Client
+
+	// trusted are the parsed TrustedProxies.
+	trusted trustedProxies
+
+	// sessions is the session store's backend, which is kept open across
+	// reloads unless its config changes.
+	sessions state.Backend
+
+	// assertions are the keys used to sign identity assertions.
+	assertions *assertionKeys
+
+	// servers are the listening servers, and stopMonitor stops the health
+	// checks.  Both are set by Run and used by Shutdown.
+	servers     []*http.Server
+	stopMonitor context.CancelFunc
+
+	// reloadLock serializes calls to Reload.
+	reloadLock sync.Mutex
+}
+
+func (l *reloadable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.RLock()
+	handler := l.handler
+	l.RUnlock()
+
+	if handler == nil {
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// hostPolicy allows certificates to be provisioned for the domains of the
+// current configuration.
+func (l *reloadable) hostPolicy(ctx context.Context, host string) error {
+	l.RLock()
+	config := l.config
+	l.RUnlock()
+
+	if config == nil {
+		return autocert.HostWhitelist()(ctx, host)
+	}
+	return autocert.HostWhitelist(config.acmeDomains()...)(ctx, host)
+}
+
+// reloadable returns the reloadable state of s, creating it if necessary.
+func (s *Server) reloadable() *reloadable {
+	liveLock.Lock()
+	defer liveLock.Unlock()
+
+	if s.live == nil {
+		s.live = &reloadable{health: &healthReport{}}
+	}
+	return s.live
+}
+
+// current returns a copy of s that uses its current configuration.
+func (s *Server) current() Server {
+	live := s.reloadable()
+	live.RLock()
+	defer live.RUnlock()
+
+	return Server{
+		Config:        live.config,
+		HTTPAddr:      s.HTTPAddr,
+		HTTPSAddr:     s.HTTPSAddr,
+		health:        live.health,
+		healthClients: live.healthClients,
+		trusted:       live.trusted,
+		log:           live.log,
+		audit:         live.audit,
+		sessions:      live.sessions,
+		assertions:    live.assertions,
+		live:          live,
+	}
+}
+
+// Reload replaces the configuration of the server.  Requests in progress,
+// including proxied WebSocket connections, finish using the old configuration
+// while new requests use c.  If c is invalid (see Config.Validate), the error
+// is returned and the old configuration remains in use.
+//
+// If c doesn't set the cookie name or secrets, the previous ones are kept so
+// users stay logged in.  Likewise a generated assertion signing key is kept
+// unless c sets Assertion.KeyFile.  Changes to the listener addresses, TLS
+// and Acme (other than the list of domains, which follows Upstreams) require
+// a restart.
+func (s *Server) Reload(c *Config) error {
+	live := s.reloadable()
+	live.reloadLock.Lock()
+	defer live.reloadLock.Unlock()
+
+	prev := s.current().Config
+	if prev != nil {
+		if c.Cookie.Name == "" {
+			c.Cookie.Name = prev.Cookie.Name
+		}
+		if c.Cookie.Secret == "" && len(c.Cookie.Secrets) == 0 && c.Cookie.SecretFile == "" {
+			c.Cookie.Secret = prev.Cookie.Secret
+			c.Cookie.Secrets = prev.Cookie.Secrets
+			c.Cookie.SecretFile = prev.Cookie.SecretFile
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	next := s.current()
+	next.Config = c
+	logger, err := c.Log.logger()
+	if err != nil {
+		return err
+	}
+	next.log = logger
+	next.assertions, err = c.assertionKeys(next.assertions)
+	if err != nil {
+		return err
+	}
+	next.trusted, err = c.trustedProxies()
+	if err != nil {
+		return err
+	}
+	prevHealthClients := next.healthClients
+	next.healthClients, err = c.healthClients()
+	if err != nil {
+		return err
+	}
+
+	// Keep the audit log open if its path hasn't changed.
+	prevAudit := next.audit
+	if prevAudit == nil || prevAudit.Path() != c.Audit.Path {
+		next.audit = nil
+		if c.Audit.Path != "" {
+			next.audit, err = audit.Open(c.Audit.Path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Likewise the session store, so users stay logged in.
+	prevSessions := next.sessions
+	if prev == nil || prev.Session.Store != c.Session.Store {
+		next.sessions, err = c.Session.Store.open()
+		if err != nil {
+			if next.audit != prevAudit {
+				next.audit.Close()
+			}
+			return err
+		}
+	}
+
+	handler, err := next.handler()
+	if err != nil {
+		if next.audit != prevAudit {
+			next.audit.Close()
+		}
+		if next.sessions != prevSessions && next.sessions != nil {
+			next.sessions.Close()
+		}
+		return err
+	}
+
+	live.Lock()
+	live.config = c
+	live.handler = handler
+	live.log = logger
+	live.audit = next.audit
+	live.sessions = next.sessions
+	live.assertions = next.assertions
+	live.healthClients = next.healthClients
+	live.trusted = next.trusted
+	live.Unlock()
+
+	for _, client := range prevHealthClients {
+		client.CloseIdleConnections()
+	}
+
+	if next.audit != prevAudit {
+		prevAudit.Close()
+	}
+	if next.sessions != prevSessions && prevSessions != nil {
+		prevSessions.Close()
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package sohop
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/davars/sohop/auth"
+	"github.com/davars/sohop/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReload(t *testing.T) {
+	foo := dummyBackend("foo")
+	defer foo.Close()
+	bar := dummyBackend("bar")
+	defer bar.Close()
+
+	config := func(upstreams map[string]UpstreamConfig) *Config {
+		return &Config{
+			Domain:    "example.com",
+			Upstreams: upstreams,
+			Auth:      auth.Config{Type: "mock", Config: json.RawMessage(`{}`)},
+			TLS:       TLSConfig{CertFile: "fixtures/cert.pem", CertKey: "fixtures/key.pem"},
+		}
+	}
+	s := &Server{Config: config(map[string]UpstreamConfig{"foo": {URL: foo.URL}})}
+	require.NoError(t, s.Reload(s.Config))
+	live := s.reloadable()
+
+	request := func(host string) (int, string) {
+		rw := httptest.NewRecorder()
+		live.ServeHTTP(rw, httptest.NewRequest("GET", "https://"+host+"/", nil))
+		return rw.Code, rw.Body.String()
+	}
+
+	code, body := request("foo.example.com")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "foo", body)
+
+	// A session created with the generated cookie secret survives the reload.
+	store, err := s.current().Config.storeConfig(nil)
+	require.NoError(t, err)
+	before := authorizedRequest(t, store, "https://oauth.example.com/session", &state.Identity{User: "someone"})
+
+	require.NoError(t, s.Reload(config(map[string]UpstreamConfig{"bar": {URL: bar.URL}})))
+
+	// Unknown subdomains require a login before they're reported missing.
+	code, _ = request("foo.example.com")
+	assert.Equal(t, http.StatusFound, code)
+	code, body = request("bar.example.com")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "bar", body)
+
+	rw := httptest.NewRecorder()
+	live.ServeHTTP(rw, before)
+	assert.Contains(t, rw.Body.String(), `"user": "someone"`)
+
+	assert.NoError(t, live.hostPolicy(context.Background(), "bar.example.com"))
+	assert.Error(t, live.hostPolicy(context.Background(), "foo.example.com"))
+
+	// Invalid configs are rejected, and the previous one stays in use.
+	invalid := []*Config{
+		config(map[string]UpstreamConfig{"foo": {URL: foo.URL, Balance: "fastest"}}),
+		config(map[string]UpstreamConfig{"foo": {URL: foo.URL, Headers: http.Header{"X-User": {"{{.Session.User"}}}}),
+		{Domain: "example.com", Auth: auth.Config{Type: "unknown"}},
+	}
+	for _, c := range invalid {
+		assert.Error(t, s.Reload(c))
+	}
+	code, body = request("bar.example.com")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "bar", body)
+}
+
+func TestReload_SessionStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	config := func(store SessionStoreConfig) *Config {
+		return &Config{
+			Domain:  "example.com",
+			Auth:    auth.Config{Type: "mock", Config: json.RawMessage(`{"ClientSecret": "hunter2"}`)},
+			TLS:     TLSConfig{CertFile: "fixtures/cert.pem", CertKey: "fixtures/key.pem"},
+			Session: SessionConfig{Store: store},
+		}
+	}
+	s := &Server{Config: config(SessionStoreConfig{Type: StoreBolt, Path: path})}
+	require.NoError(t, s.Reload(s.Config))
+	live := s.reloadable()
+
+	store, err := s.current().Config.storeConfig(s.current().sessions)
+	require.NoError(t, err)
+	login := authorizedRequest(t, store, "https://oauth.example.com/session", &state.Identity{User: "someone"})
+	user := func() string {
+		req := httptest.NewRequest("GET", "https://oauth.example.com/session", nil)
+		for _, cookie := range login.Cookies() {
+			req.AddCookie(cookie)
+		}
+		rw := httptest.NewRecorder()
+		live.ServeHTTP(rw, req)
+		var session struct{ User string }
+		require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &session))
+		return session.User
+	}
+
+	// The database stays open across reloads.
+	require.NoError(t, s.Reload(config(SessionStoreConfig{Type: StoreBolt, Path: path})))
+	assert.Equal(t, "someone", user())
+
+	n, err := s.RevokeUser("someone")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "", user())
+
+	// Changing the store closes the database.
+	require.NoError(t, s.Reload(config(SessionStoreConfig{Type: StoreCookie})))
+	b, err := state.OpenBoltBackend(path)
+	require.NoError(t, err)
+	b.Close()
+
+	_, err = s.RevokeUser("someone")
+	assert.Equal(t, ErrSessionsNotStored, err)
+}
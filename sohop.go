@@ -2,20 +2,28 @@
 package sohop
 
 import (
+	"context"
+	"crypto/hkdf"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"math"
-	"math/big"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/davars/sohop/acme"
+	"github.com/davars/sohop/audit"
 	"github.com/davars/sohop/auth"
 	"github.com/davars/sohop/state"
 	"github.com/golang/protobuf/jsonpb"
@@ -40,10 +48,38 @@ type Config struct {
 	// Cookie configures the session cookie store.
 	Cookie CookieConfig
 
+	// Session configures how long users stay logged in.
+	Session SessionConfig
+
 	// TLS can be used to specify a static TLS configuration for the server.
 	// It is overridden by the values from the AcmeWrapper if Acme is used.
 	TLS TLSConfig
 
+	// TrustedProxies lists the addresses (IPs or CIDRs) of proxies in front
+	// of sohop, such as load balancers.  The client address, scheme and host
+	// they report in Forwarded or X-Forwarded-* headers are believed, and
+	// requests they forward over HTTP that the client made over HTTPS are
+	// served rather than redirected.  Those headers are ignored from other
+	// clients.
+	TrustedProxies []string
+
+	// Log configures the access log and the logging of other events.
+	Log LogConfig
+
+	// Audit configures the audit log.
+	Audit AuditConfig
+
+	// Admin, if set, enables the admin API.
+	Admin *AdminConfig
+
+	// Bearer configures authentication with bearer credentials, for clients
+	// that can't log in interactively.
+	Bearer BearerConfig
+
+	// Assertion configures the keys used to sign the identity assertions
+	// sent to upstreams with UpstreamConfig.Assertion set.
+	Assertion AssertionConfig
+
 	// Acme configures automatic provisioning and renewal of TLS certificates
 	// using the ACME protocol.
 	Acme *acme.Config
@@ -51,21 +87,215 @@ type Config struct {
 	// Deprecated.  See https://godoc.org/github.com/davars/sohop/auth#Config.
 	Github json.RawMessage
 
-	// Deprecated.  See https://godoc.org/github.com/davars/sohop/auth#Config.
+	// Deprecated.  Use the google-domain auther instead.  See
+	// https://godoc.org/github.com/davars/sohop/auth#GoogleAuth.
 	Google json.RawMessage
 }
 
 // CookieConfig configures the session cookie store.
 type CookieConfig struct {
-	// Name is the name of the session cookie.  If not set, a random name will
-	// be generated on start-up.
+	// Name is the name of the session cookie.  If not set, a name is derived
+	// from Domain, so it stays the same when secrets are rotated.
 	Name string
 
 	// Secret is the private key used to authenticate session cookies. Should be
-	// a hex-encoded string 128 characters in length (64 byte key).  If not set,
-	// a random key will be generated on start-up.  Run `openssl rand -hex 64`
-	// to generate a key.
+	// a hex-encoded string 64 characters in length (32 byte key).  Run
+	// `openssl rand -hex 32` to generate a key.
+	//
+	// If none of Secret, Secrets or SecretFile are set, a random key is
+	// generated on start-up, so users are logged out when sohop restarts.  If
+	// only SecretFile is set and the file doesn't exist, a key is generated
+	// and written to it.
 	Secret string
+
+	// Secrets lists keys in the same format as Secret, to allow keys to be
+	// rotated without logging everyone out.  The first key (Secret, if it's
+	// set) is used to create cookies; all of them are accepted.
+	Secrets []string
+
+	// SecretFile names a file containing keys, separated by whitespace, which
+	// are accepted after those in Secret and Secrets.  The file is read again
+	// when the config is reloaded.
+	SecretFile string
+
+	// Replicated is set when several instances of sohop serve the Domain,
+	// such as replicas behind a load balancer.  They must share keys, so
+	// Secret, Secrets or an existing SecretFile is required.
+	Replicated bool
+}
+
+// secrets returns the keys in Secret, Secrets and SecretFile, in that order.
+func (c CookieConfig) secrets() ([]string, error) {
+	var secrets []string
+	if c.Secret != "" {
+		secrets = append(secrets, c.Secret)
+	}
+	secrets = append(secrets, c.Secrets...)
+	if c.SecretFile != "" {
+		b, err := os.ReadFile(c.SecretFile)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, strings.Fields(string(b))...)
+	}
+	return secrets, nil
+}
+
+// createSecretFile writes a random key to SecretFile, which must not exist.
+func (c CookieConfig) createSecretFile() error {
+	var key [32]byte
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(c.SecretFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(key[:])); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// SessionConfig configures how long users stay logged in.
+type SessionConfig struct {
+	// MaxAge is how long a session lasts after the user logs in, whether or
+	// not they're active.  Defaults to 24 hours.
+	MaxAge Duration
+
+	// IdleTimeout, if set, ends sessions that haven't been used for this long.
+	// Requests to upstreams that require auth (and to oauth.<domain>/verify)
+	// renew the session, up to MaxAge.
+	IdleTimeout Duration
+
+	// LoginTimeout is how long users have to complete the login flow once
+	// they've been sent to the auth provider.  Defaults to 5 minutes.
+	LoginTimeout Duration
+
+	// Store configures where sessions are kept.  By default they're kept in
+	// the session cookie.
+	Store SessionStoreConfig
+}
+
+// Session store types.
+const (
+	StoreCookie = "cookie"
+	StoreMemory = "memory"
+	StoreBolt   = "bolt"
+)
+
+// SessionStoreConfig configures where sessions are kept.
+type SessionStoreConfig struct {
+	// Type is "cookie" to keep sessions in the (encrypted) session cookie,
+	// "memory" to keep them in memory, or "bolt" to keep them in a bbolt
+	// database at Path.  With "memory" and "bolt" the cookie holds only a
+	// session ID, so sessions can be listed and revoked.
+	Type string
+
+	// Path is the database file for the "bolt" store.
+	Path string
+}
+
+// open returns the backend for the configured store, or nil if sessions are
+// kept in cookies.
+func (c SessionStoreConfig) open() (state.Backend, error) {
+	switch c.Type {
+	case "", StoreCookie:
+		return nil, nil
+	case StoreMemory:
+		return state.NewMemoryBackend(), nil
+	case StoreBolt:
+		return state.OpenBoltBackend(c.Path)
+	default:
+		return nil, fmt.Errorf("unknown session store %q", c.Type)
+	}
+}
+
+// A Duration is a time.Duration that's written in config files as a string
+// like "8h" or "90m".
+type Duration time.Duration
+
+// UnmarshalJSON accepts a string parsed by time.ParseDuration, or a number of
+// nanoseconds.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("duration should be a string like \"8h\": %s", data)
+		}
+		*d = Duration(n)
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// BearerConfig configures authentication with "Authorization: Bearer"
+// credentials, for scripts and other clients that can't log in interactively.
+// Requests with a valid credential are treated as if the user had logged in.
+type BearerConfig struct {
+	// APIKeys are static credentials.  Run `sohop apikey` to generate one.
+	APIKeys []auth.APIKey
+
+	// TokenSecret is the hex-encoded 32 byte key used to sign tokens minted
+	// by `sohop token` (see Config.MintToken).  If not set, only API keys are
+	// accepted.
+	TokenSecret string
+}
+
+// bearerAuth returns the BearerAuth for the configured credentials, or nil if
+// there aren't any.
+func (c *Config) bearerAuth() (*auth.BearerAuth, error) {
+	if len(c.Bearer.APIKeys) == 0 && c.Bearer.TokenSecret == "" {
+		return nil, nil
+	}
+	return auth.NewBearerAuth(c.Bearer.APIKeys, c.Bearer.TokenSecret, c.Domain)
+}
+
+// MintToken returns a bearer token identifying id, which expires after ttl.
+// It requires Bearer.TokenSecret.
+func (c *Config) MintToken(id *state.Identity, ttl time.Duration) (string, error) {
+	b, err := c.bearerAuth()
+	if err != nil {
+		return "", err
+	}
+	if b == nil {
+		return "", errors.New("Bearer.TokenSecret is not set")
+	}
+	return b.Mint(id, ttl)
+}
+
+// LogConfig configures logging.
+type LogConfig struct {
+	// Format is the format of log lines.  "combined" (the default) writes the
+	// access log to stdout in the Apache combined log format, and other events
+	// to stderr as text.  "json" and "text" write structured access log lines
+	// and events to stdout as JSON or logfmt-style text.
+	Format string
+
+	// Level is the minimum level of events to log: "debug", "info" (the
+	// default), "warn" or "error".
+	Level string
+}
+
+// AuditConfig configures the audit log, which records logins, logouts and
+// access denied by policies as JSON lines.  See
+// https://godoc.org/github.com/davars/sohop/audit#Event.
+type AuditConfig struct {
+	// Path is the file to append the audit log to, or "-" for stdout.  If
+	// not set, there is no audit log.
+	Path string
 }
 
 // TLSConfig configures the server certificate.
@@ -76,6 +306,43 @@ type TLSConfig struct {
 	// CertKey is a path to the unencrypted PEM-encoded private key for the
 	// server certificate.
 	CertKey string
+
+	// ClientCAFile is a path to a bundle of PEM-encoded CA certificates.  If
+	// set, clients may present a certificate issued by one of them, which
+	// upstreams with ClientCert set accept in place of a login.  Changes
+	// require a restart.
+	ClientCAFile string
+
+	// ClientCertUser is the field of a client certificate that names the
+	// user: "cn" (the subject's common name, the default) or "email" (its
+	// first email address).
+	ClientCertUser string
+}
+
+// clientCAs returns the pool of CAs client certificates are verified
+// against, or nil if ClientCAFile isn't set.
+func (c TLSConfig) clientCAs() (*x509.CertPool, error) {
+	if c.ClientCAFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", c.ClientCAFile)
+	}
+	return pool, nil
+}
+
+// certAuth returns the CertAuth for client certificates, or nil if they
+// aren't accepted.
+func (c *Config) certAuth() (*auth.CertAuth, error) {
+	if c.TLS.ClientCAFile == "" {
+		return nil, nil
+	}
+	return auth.NewCertAuth(c.TLS.ClientCertUser)
 }
 
 // A Server is an OAuth-authenticating reverse proxy.
@@ -84,82 +351,189 @@ type Server struct {
 	HTTPAddr  string
 	HTTPSAddr string
 
-	proxy       http.Handler
-	health      *healthReport
-	storeConfig state.Store
+	// ShutdownTimeout is how long Run waits for requests in progress to
+	// finish once its context is done.  Defaults to 30 seconds.
+	ShutdownTimeout time.Duration
+
+	health        *healthReport
+	healthClients map[string]*http.Client
+	trusted       trustedProxies
+	storeConfig   state.Store
+	sessions      state.Backend
+	assertions    *assertionKeys
+	log           *slog.Logger
+	audit         *audit.Log
+	live          *reloadable
 }
 
-func check(err error) {
+const defaultShutdownTimeout = 30 * time.Second
+
+// Run validates the config (see Config.Validate) and bootstraps the
+// listeners, then serves requests until ctx is done, at which point it shuts
+// the server down gracefully (see Shutdown).  It returns an error if the
+// server can't be started or a listener fails, and nil once the server has
+// been shut down.  The configuration can be replaced while it's running using
+// Reload.
+func (s *Server) Run(ctx context.Context) error {
+	live := s.reloadable()
+	if err := s.Reload(s.Config); err != nil {
+		return err
+	}
+	clientCAs, err := s.Config.TLS.clientCAs()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-}
 
-// Run bootstraps the listeners then waits forever.
-func (s Server) Run() {
-	var err error
+	httpsServer := &http.Server{
+		Addr:      s.HTTPSAddr,
+		Handler:   live,
+		TLSConfig: &tls.Config{},
+	}
+	var m *autocert.Manager
+	if s.Config.Acme != nil {
+		s.Config.Acme.Domains = s.Config.acmeDomains()
 
-	go func() {
-		s.health = &healthReport{}
-		for {
-			s.performCheck()
-			time.Sleep(5 * time.Second)
+		m, err = s.Config.Acme.Manager()
+		if err != nil {
+			return err
 		}
-	}()
+		m.HostPolicy = live.hostPolicy
 
-	var m *autocert.Manager
-	if s.Config.Acme != nil {
-		domains := []string{}
-		for _, subdomain := range []string{"oauth", "health"} {
-			domains = append(domains, fmt.Sprintf("%s.%s", subdomain, s.Config.Domain))
+		httpsServer.TLSConfig = &tls.Config{
+			GetCertificate: m.GetCertificate,
+			NextProtos:     []string{"h2"},
 		}
-		for subdomain := range s.Config.Upstreams {
-			domains = append(domains, fmt.Sprintf("%s.%s", subdomain, s.Config.Domain))
+	}
+	if clientCAs != nil {
+		// Clients without a certificate can still log in.
+		httpsServer.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		httpsServer.TLSConfig.ClientCAs = clientCAs
+	}
+
+	var redirect http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := s.current().trusted.resolve(r)
+		// A trusted proxy may have terminated TLS already.
+		if f.proto == "https" {
+			live.ServeHTTP(w, r)
+			return
 		}
+		r.URL.Scheme = "https"
+		r.URL.Host = f.host + s.HTTPSAddr
+		http.Redirect(w, r, r.URL.String(), http.StatusMovedPermanently)
+		return
+	})
+	if m != nil {
+		redirect = m.HTTPHandler(redirect)
+	}
+	httpServer := &http.Server{
+		Addr:    s.HTTPAddr,
+		Handler: redirect,
+	}
 
-		s.Config.Acme.Domains = domains
+	monitorCtx, stopMonitor := context.WithCancel(context.Background())
+	live.Lock()
+	live.servers = []*http.Server{httpsServer, httpServer}
+	live.stopMonitor = stopMonitor
+	live.Unlock()
+	go s.monitor(monitorCtx)
 
-		m, err = s.Config.Acme.Manager()
-		check(err)
-	}
+	errs := make(chan error, 2)
 	go func() {
 		if m == nil {
-			s.Config.checkTLS()
-			err = http.ListenAndServeTLS(s.HTTPSAddr, s.Config.TLS.CertFile, s.Config.TLS.CertKey, s.handler())
-			check(err)
+			errs <- httpsServer.ListenAndServeTLS(s.Config.TLS.CertFile, s.Config.TLS.CertKey)
 		} else {
-			tlsConfig := &tls.Config{
-				GetCertificate: m.GetCertificate,
-				NextProtos:     []string{"h2"},
-			}
+			errs <- httpsServer.ListenAndServeTLS("", "")
+		}
+	}()
+	go func() {
+		errs <- httpServer.ListenAndServe()
+	}()
 
-			server := &http.Server{
-				Addr:      s.HTTPSAddr,
-				Handler:   s.handler(),
-				TLSConfig: tlsConfig,
-			}
+	timeout := s.ShutdownTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
 
-			err = server.ListenAndServeTLS("", "")
-			check(err)
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return s.Shutdown(shutdownCtx)
+	case err := <-errs:
+		if err == http.ErrServerClosed {
+			// Shutdown was called.
+			return nil
 		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		s.Shutdown(shutdownCtx)
+		return err
+	}
+}
 
-	}()
-	go func() {
-		var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			r.URL.Scheme = "https"
-			r.URL.Host = r.Host + s.HTTPSAddr
-			http.Redirect(w, r, r.URL.String(), http.StatusMovedPermanently)
-			return
-		})
+// Shutdown gracefully shuts down a running server: it stops accepting
+// connections, waits for requests in progress to finish and stops the health
+// checks, then closes the audit log and session store.  If ctx is done first,
+// the remaining connections are closed and the context's error is returned.
+// Proxied WebSocket connections aren't waited for.
+func (s *Server) Shutdown(ctx context.Context) error {
+	live := s.reloadable()
+	live.Lock()
+	servers, stopMonitor, auditLog, sessions := live.servers, live.stopMonitor, live.audit, live.sessions
+	live.Unlock()
+
+	if stopMonitor != nil {
+		stopMonitor()
+	}
 
-		if m != nil {
-			handler = m.HTTPHandler(handler)
+	var firstErr error
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+			if firstErr == nil {
+				firstErr = err
+			}
 		}
+	}
+	auditLog.Close()
+	if sessions != nil {
+		sessions.Close()
+	}
+	return firstErr
+}
 
-		err := http.ListenAndServe(s.HTTPAddr, handler)
-		check(err)
-	}()
-	select {}
+// ErrSessionsNotStored is returned when sessions can't be revoked because
+// they're kept in cookies.
+var ErrSessionsNotStored = errors.New(`sessions are kept in cookies, set "Session.Store" to revoke them`)
+
+// RevokeUser logs user out of all of their sessions, and returns how many
+// there were.  It requires a Session.Store other than "cookie".
+func (s *Server) RevokeUser(user string) (int, error) {
+	current := s.current()
+	if current.sessions == nil {
+		return 0, ErrSessionsNotStored
+	}
+	n, err := state.RevokeUser(current.sessions, user)
+	if err != nil {
+		return n, err
+	}
+	current.logger().Info("sessions revoked", "user", user, "sessions", n)
+	return n, nil
+}
+
+// acmeDomains returns the domains to provision certificates for.
+func (c *Config) acmeDomains() []string {
+	domains := []string{}
+	for _, subdomain := range []string{"oauth", "health"} {
+		domains = append(domains, fmt.Sprintf("%s.%s", subdomain, c.Domain))
+	}
+	if c.Admin != nil {
+		domains = append(domains, fmt.Sprintf("%s.%s", c.Admin.subdomain(), c.Domain))
+	}
+	for subdomain := range c.Upstreams {
+		domains = append(domains, fmt.Sprintf("%s.%s", subdomain, c.Domain))
+	}
+	return domains
 }
 
 // UpstreamConfig configures a single upstream endpoint.
@@ -167,75 +541,215 @@ type UpstreamConfig struct {
 	// The URL of the upstream server.
 	URL string
 
+	// URLs lists additional upstream servers.  Requests are balanced across
+	// URL and URLs, skipping servers that fail their health check.
+	URLs []string
+
+	// Balance is the strategy used to balance requests across URLs:
+	// "round-robin" (the default), "least-connections" or "random".
+	Balance string
+
 	// Auth is whether requests to this upstream require authentication.
 	Auth bool
 
+	// SessionMaxAge, if set, requires users to have logged in within this
+	// long to access this upstream.  Users with older sessions are asked to
+	// log in again.  Setting SessionMaxAge implies Auth.
+	SessionMaxAge Duration
+
+	// ClientCert is whether a verified client certificate (see
+	// TLSConfig.ClientCAFile) identifies the user, so they don't need to log
+	// in.  Users without one log in as usual.  Setting ClientCert implies
+	// Auth.
+	ClientCert bool
+
+	// Policy restricts which authenticated users may access this upstream.
+	// Users that don't satisfy it get a 403 response.  Setting a Policy
+	// implies Auth.
+	Policy *Policy
+
 	// HealthCheck is a URL to use as a health check, if different from
 	// Upstreams.URL (for example if UpstreamConfig.URL returns a 302 response).
-	// It should return a 200 response if the upstream is healthy.
+	// It should return a 200 response if the upstream is healthy.  If URLs is
+	// set, the path of HealthCheck is checked on each server.
 	HealthCheck string
 
 	// WebSocket is a ws:// or wss:// URL receive proxied WebSocket connections.
 	WebSocket string
 
+	// Routes can be used to proxy different paths to different servers.  The
+	// route with the longest matching Path is used; URL and WebSocket serve
+	// as the route for "/" unless Routes includes one.
+	Routes []RouteConfig
+
+	// TLS configures connections to the upstream's servers, including
+	// WebSocket connections and health checks.  If not set, the servers'
+	// certificates aren't verified.
+	TLS *UpstreamTLSConfig
+
+	// Assertion, if set, sends the upstream a signed JWT identifying the
+	// user, which it can verify using the keys published at
+	// https://oauth.<Domain>/.well-known/jwks.json rather than trusting a
+	// header set by Headers.
+	Assertion *UpstreamAssertionConfig
+
 	// Headers can be used to replace the headers of an incoming request
-	// before it is sent upstream.  The values are templates, evaluated with the
-	// current session available as `.Session`.
+	// before it is sent upstream.  The values are templates, evaluated with
+	// TemplateData: the current session is available as `.Session`, the
+	// incoming request as `.Request` and the upstream's name as `.Upstream`.
+	// Besides the text/template builtins, templates can use the functions
+	// base64, lower, upper, join, default and hmac.
 	Headers http.Header
+
+	// ResponseHeaders are templates, like Headers, that replace the headers
+	// of the upstream's responses.
+	ResponseHeaders http.Header
+
+	// RemoveHeaders and RemoveResponseHeaders list headers removed from
+	// requests before they're sent upstream, and from the upstream's
+	// responses, before Headers and ResponseHeaders are applied.
+	RemoveHeaders         []string
+	RemoveResponseHeaders []string
 }
 
-func (c *Config) storeConfig() state.Store {
-	if c.Cookie.Name == "" {
-		n, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
-		if err != nil {
-			log.Fatal(err)
+// UpstreamTLSConfig configures TLS connections to an upstream's servers.
+type UpstreamTLSConfig struct {
+	// Verify enables verification of the servers' certificates.
+	Verify bool
+
+	// CAFile is a path to a bundle of PEM-encoded CA certificates used to
+	// verify the servers' certificates, instead of the system's.  Implies
+	// Verify.
+	CAFile string
+
+	// ServerName overrides the host name used to verify the servers'
+	// certificates (and sent in the TLS handshake).
+	ServerName string
+
+	// CertFile and KeyFile are paths to a PEM-encoded client certificate and
+	// its unencrypted private key, presented to servers that request one.
+	CertFile string
+	KeyFile  string
+}
+
+// RouteConfig configures the upstream servers for requests to an upstream's
+// subdomain whose path starts with Path.
+type RouteConfig struct {
+	// Path is the path prefix the route applies to, e.g. "/api".  It matches
+	// "/api" and "/api/..." but not "/apiary".
+	Path string
+
+	// The URL of the upstream server for this route.
+	URL string
+
+	// URLs lists additional upstream servers for this route.  See
+	// UpstreamConfig.URLs.
+	URLs []string
+
+	// Balance is the strategy used to balance requests across URLs.  See
+	// UpstreamConfig.Balance.
+	Balance string
+
+	// HealthCheck is the path (or URL, if there's a single server) used to
+	// check the health of this route's servers.  If not set, each server's
+	// URL is checked.
+	HealthCheck string
+
+	// WebSocket is a ws:// or wss:// URL receive proxied WebSocket connections
+	// for this route.
+	WebSocket string
+
+	// StripPrefix removes Path from the request path before it's proxied, so
+	// a request for /api/users is sent to the upstream as /users.
+	StripPrefix bool
+
+	// AddPrefix is prepended to the request path (after StripPrefix) before
+	// it's proxied.
+	AddPrefix string
+}
+
+func (c *Config) storeConfig(backend state.Backend) (state.Store, error) {
+	secrets, err := c.Cookie.secrets()
+	if errors.Is(err, fs.ErrNotExist) && c.Cookie.Secret == "" && len(c.Cookie.Secrets) == 0 && !c.Cookie.Replicated {
+		// Generate the key once, so sessions survive restarts.
+		if err = c.Cookie.createSecretFile(); err == nil {
+			secrets, err = c.Cookie.secrets()
 		}
-		c.Cookie.Name = fmt.Sprintf("_s%d", n)
 	}
-	if c.Cookie.Secret == "" {
+	if err != nil {
+		return nil, err
+	}
+	if len(secrets) == 0 {
+		if c.Cookie.Replicated {
+			return nil, errors.New("Cookie.Replicated requires a secret")
+		}
 		var key [32]byte
 		if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
-			panic(err) // don't want to continue encrypting anything
+			return nil, err // don't want to continue encrypting anything
 		}
 		c.Cookie.Secret = hex.EncodeToString(key[:])
+		secrets = []string{c.Cookie.Secret}
 	}
-	conf, err := state.New(c.Cookie.Name, c.Cookie.Secret, c.Domain)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return conf
-}
-
-func (c *Config) checkTLS() {
-	if _, err := os.Stat(c.TLS.CertFile); err != nil {
-		log.Fatalf("cannot find TLS.CertFile: %v", err)
-	}
-	if _, err := os.Stat(c.TLS.CertKey); err != nil {
-		log.Fatalf("cannot find TLS.CertKey: %v", err)
+	if c.Cookie.Name == "" {
+		name, err := hkdf.Key(sha256.New, []byte(strings.ToLower(c.Domain)), nil, "sohop cookie name", 8)
+		if err != nil {
+			return nil, err
+		}
+		c.Cookie.Name = fmt.Sprintf("_s%d", binary.BigEndian.Uint64(name)&math.MaxInt64)
 	}
+	return state.NewWithOptions(c.Cookie.Name, secrets[0], c.Domain, state.Options{
+		SessionAge:      time.Duration(c.Session.MaxAge),
+		IdleTimeout:     time.Duration(c.Session.IdleTimeout),
+		StateAge:        time.Duration(c.Session.LoginTimeout),
+		PreviousSecrets: secrets[1:],
+		Backend:         backend,
+	})
 }
 
-func (c *Config) auther() auth.Auther {
+func (c *Config) auther() (auth.Auther, error) {
 	if c.Github != nil || c.Google != nil {
-		log.Fatal("Authorization configuration has changed.  Refer to the README regarding the \"Auth\" key.")
+		return nil, errors.New("Authorization configuration has changed.  Refer to the README regarding the \"Auth\" key.")
 	}
 	a, err := auth.NewAuther(c.Auth)
 	if err != nil {
-		log.Fatalf("NewAuther: %v", err)
+		return nil, fmt.Errorf("NewAuther: %v", err)
 	}
-	return a
+	return a, nil
 }
 
-func (s Server) handler() http.Handler {
+func (s Server) handler() (http.Handler, error) {
 	router := mux.NewRouter()
 	router.NotFoundHandler = http.HandlerFunc(notFound)
 
 	conf := s.Config
 	oauthRouter := router.Host(fmt.Sprintf("oauth.%s", conf.Domain)).Subrouter()
 
-	auther := conf.auther()
-	s.storeConfig = conf.storeConfig()
+	auther, err := conf.auther()
+	if err != nil {
+		return nil, err
+	}
+	s.storeConfig, err = conf.storeConfig(s.sessions)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := s.ProxyHandler()
+	if err != nil {
+		return nil, err
+	}
+	bearer, err := conf.bearerAuth()
+	if err != nil {
+		return nil, err
+	}
+	certs, err := conf.certAuth()
+	if err != nil {
+		return nil, err
+	}
+
 	oauthRouter.Path("/authorized").Handler(auth.Handler(auther, s.storeConfig))
+	oauthRouter.Path("/logout").Handler(auth.LogoutHandler(auther, s.storeConfig, conf.Domain))
+	oauthRouter.Path("/start").Handler(auth.StartHandler(auther, s.storeConfig, conf.Domain))
+	oauthRouter.Path("/verify").Handler(bearer.Middleware(s.VerifyHandler()))
+	oauthRouter.Path("/.well-known/jwks.json").Handler(s.JWKSHandler())
 	authenticating := auth.Middleware(auther, s.storeConfig)
 
 	oauthRouter.Path("/session").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -245,10 +759,14 @@ func (s Server) handler() http.Handler {
 	healthRouter := router.Host(fmt.Sprintf("health.%s", conf.Domain)).Subrouter()
 	healthRouter.Path("/check").Handler(s.HealthHandler())
 
+	if conf.Admin != nil {
+		router.Host(fmt.Sprintf("%s.%s", conf.Admin.subdomain(), conf.Domain)).
+			Handler(bearer.Middleware(authenticating(s.adminAuthorizing(s.AdminHandler()))))
+	}
+
 	proxyRouter := router.Host(fmt.Sprintf("{subdomain:[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?}.%s", conf.Domain)).Subrouter()
-	proxy := s.ProxyHandler()
-	proxyRouter.MatcherFunc(requiresAuth(conf)).Handler(authenticating(proxy))
+	proxyRouter.MatcherFunc(requiresAuth(conf)).Handler(s.maxAge(s.clientCerts(certs, bearer.Middleware(authenticating(s.authorizing(proxy))))))
 	proxyRouter.PathPrefix("/").Handler(proxy)
 
-	return logging(router)
+	return forwarding(s.trusted, "oauth."+conf.Domain, s.logging(router)), nil
 }
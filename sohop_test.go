@@ -0,0 +1,352 @@
+package sohop
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/davars/sohop/auth"
+	"github.com/davars/sohop/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testServer(upstreamURL, httpAddr, httpsAddr string) *Server {
+	return &Server{
+		Config: &Config{
+			Domain:    "example.com",
+			Upstreams: map[string]UpstreamConfig{"foo": {URL: upstreamURL}},
+			Auth:      auth.Config{Type: "mock", Config: json.RawMessage(`{}`)},
+			TLS: TLSConfig{
+				CertFile: "fixtures/cert.pem",
+				CertKey:  "fixtures/key.pem",
+			},
+		},
+		HTTPAddr:  httpAddr,
+		HTTPSAddr: httpsAddr,
+	}
+}
+
+func TestRun_Shutdown(t *testing.T) {
+	started := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/slow" {
+			return // health check
+		}
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "slow")
+	}))
+	defer slow.Close()
+
+	s := testServer(slow.URL, "127.0.0.1:42081", "127.0.0.1:42444")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	time.Sleep(time.Second)
+
+	body := make(chan string, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "https://127.0.0.1:42444/slow", nil)
+		req.Host = "foo.example.com"
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		resp, err := client.Do(req)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(b)
+	}()
+
+	// The request in progress finishes before Run returns.
+	<-started
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after its context was canceled")
+	}
+	assert.Equal(t, "slow", <-body)
+
+	_, err := net.Dial("tcp", "127.0.0.1:42444")
+	assert.Error(t, err, "listener still open")
+}
+
+func TestRun_ClientCert(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-User"))
+	}))
+	defer upstream.Close()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Devices CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	require.NoError(t, err)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600))
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	clientDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "sensor-1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caTemplate, clientKey.Public(), caKey)
+	require.NoError(t, err)
+	clientCert := tls.Certificate{Certificate: [][]byte{clientDER}, PrivateKey: clientKey}
+
+	s := testServer(upstream.URL, "127.0.0.1:42083", "127.0.0.1:42447")
+	s.Config.TLS.ClientCAFile = caFile
+	s.Config.Upstreams = map[string]UpstreamConfig{
+		"devices": {URL: upstream.URL, ClientCert: true, Headers: http.Header{"X-User": {"{{.Session.User}}"}}},
+		"web":     {URL: upstream.URL, Auth: true, Headers: http.Header{"X-User": {"{{.Session.User}}"}}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	time.Sleep(time.Second)
+
+	get := func(host string, certs []tls.Certificate) *http.Response {
+		req, err := http.NewRequest("GET", "https://127.0.0.1:42447/", nil)
+		require.NoError(t, err)
+		req.Host = host
+		client := &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: certs}},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := get("devices.example.com", []tls.Certificate{clientCert})
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "sensor-1", string(b))
+
+	// Without a certificate, or on upstreams that don't accept them, users
+	// have to log in.
+	assert.Equal(t, http.StatusFound, get("devices.example.com", nil).StatusCode)
+	assert.Equal(t, http.StatusFound, get("web.example.com", []tls.Certificate{clientCert}).StatusCode)
+}
+
+func TestRun_TrustedProxy(t *testing.T) {
+	foo := dummyBackend("foo")
+	defer foo.Close()
+
+	s := testServer(foo.URL, "127.0.0.1:42084", "127.0.0.1:42448")
+	s.Config.TrustedProxies = []string{"127.0.0.1"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	time.Sleep(time.Second)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(header http.Header) *http.Response {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:42084/", nil)
+		require.NoError(t, err)
+		req.Host = "foo.example.com"
+		req.Header = header
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// Requests for which the proxy terminated TLS are served over HTTP.
+	resp := get(http.Header{"X-Forwarded-Proto": {"https"}})
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "foo", string(b))
+
+	assert.Equal(t, http.StatusMovedPermanently, get(http.Header{}).StatusCode)
+}
+
+func TestRun_Errors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	s := testServer("http://127.0.0.1:1", l.Addr().String(), "127.0.0.1:42445")
+	assert.Error(t, s.Run(context.Background()), "address in use")
+
+	s = testServer("http://127.0.0.1:1", "127.0.0.1:42082", "127.0.0.1:42446")
+	s.Config.TLS.CertFile = "fixtures/missing.pem"
+	assert.EqualError(t, s.Run(context.Background()), "TLS: open fixtures/missing.pem: no such file or directory")
+
+	s = testServer("http://127.0.0.1:1", "127.0.0.1:42082", "127.0.0.1:42446")
+	s.Config.Auth.Type = "unknown"
+	assert.Error(t, s.Run(context.Background()))
+}
+
+func TestDuration_JSON(t *testing.T) {
+	var c SessionConfig
+	require.NoError(t, json.Unmarshal([]byte(`{"MaxAge": "8h", "IdleTimeout": 60000000000}`), &c))
+	assert.Equal(t, Duration(8*time.Hour), c.MaxAge)
+	assert.Equal(t, Duration(time.Minute), c.IdleTimeout)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"MaxAge": "8 hours"}`), &c))
+	assert.Error(t, json.Unmarshal([]byte(`{"MaxAge": true}`), &c))
+
+	b, err := json.Marshal(c.MaxAge)
+	require.NoError(t, err)
+	assert.Equal(t, `"8h0m0s"`, string(b))
+}
+
+func TestConfig_storeConfig(t *testing.T) {
+	const (
+		oldSecret = "3c0767ada2466a92a59c1214061441713aeafe6d115e29aa376c0f9758cdf0f5"
+		newSecret = "0f5e29aa376c0f9758cdf0f53c0767ada2466a92a59c1214061441713aeafe6d"
+	)
+
+	config := func(cookie CookieConfig) *Config {
+		return &Config{Domain: "example.com", Cookie: cookie}
+	}
+
+	// login returns a request carrying a session cookie created by c.
+	login := func(t *testing.T, c *Config) *http.Request {
+		store, err := c.storeConfig(nil)
+		require.NoError(t, err)
+		rw := httptest.NewRecorder()
+		require.NoError(t, store.Authorize(rw, httptest.NewRequest("GET", "https://example.com/", nil), &state.Identity{User: "user"}))
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		for _, cookie := range rw.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+	authorized := func(t *testing.T, c *Config, req *http.Request) bool {
+		store, err := c.storeConfig(nil)
+		require.NoError(t, err)
+		// The store caches the session in the request's context.
+		return store.IsAuthorized(req.Clone(context.Background()))
+	}
+
+	t.Run("random", func(t *testing.T) {
+		req := login(t, config(CookieConfig{}))
+		assert.False(t, authorized(t, config(CookieConfig{}), req))
+	})
+
+	t.Run("generated file", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "secrets")
+		a, b := config(CookieConfig{SecretFile: file}), config(CookieConfig{SecretFile: file})
+		req := login(t, a)
+		assert.True(t, authorized(t, b, req))
+		assert.Equal(t, a.Cookie.Name, b.Cookie.Name)
+
+		info, err := os.Stat(file)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	})
+
+	t.Run("replicated", func(t *testing.T) {
+		_, err := config(CookieConfig{Replicated: true}).storeConfig(nil)
+		assert.Error(t, err)
+		_, err = config(CookieConfig{Replicated: true, SecretFile: filepath.Join(t.TempDir(), "secrets")}).storeConfig(nil)
+		assert.Error(t, err)
+
+		a, b := config(CookieConfig{Replicated: true, Secret: oldSecret}), config(CookieConfig{Replicated: true, Secret: oldSecret})
+		assert.True(t, authorized(t, b, login(t, a)))
+		assert.Equal(t, a.Cookie.Name, b.Cookie.Name)
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		req := login(t, config(CookieConfig{Name: "s", Secret: oldSecret}))
+		assert.True(t, authorized(t, config(CookieConfig{Name: "s", Secrets: []string{newSecret, oldSecret}}), req))
+		assert.False(t, authorized(t, config(CookieConfig{Name: "s", Secret: newSecret}), req))
+
+		file := filepath.Join(t.TempDir(), "secrets")
+		require.NoError(t, os.WriteFile(file, []byte(oldSecret+"\n"), 0600))
+		assert.True(t, authorized(t, config(CookieConfig{Name: "s", Secret: newSecret, SecretFile: file}), req))
+	})
+
+	t.Run("rotation without name", func(t *testing.T) {
+		req := login(t, config(CookieConfig{Secret: oldSecret}))
+		assert.True(t, authorized(t, config(CookieConfig{Secrets: []string{newSecret, oldSecret}}), req))
+	})
+}
+
+func TestBearer(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-User")+" "+r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+
+	key, hash, err := auth.NewAPIKey()
+	require.NoError(t, err)
+	s := &Server{Config: &Config{
+		Domain: "example.com",
+		Upstreams: map[string]UpstreamConfig{"foo": {
+			URL:     upstream.URL,
+			Auth:    true,
+			Headers: http.Header{"X-User": {"{{.Session.User}}"}},
+		}},
+		Auth: auth.Config{Type: "mock", Config: json.RawMessage(`{}`)},
+		TLS:  TLSConfig{CertFile: "fixtures/cert.pem", CertKey: "fixtures/key.pem"},
+		Bearer: BearerConfig{
+			APIKeys:     []auth.APIKey{{Hash: hash, User: "deploy"}},
+			TokenSecret: "3c0767ada2466a92a59c1214061441713aeafe6d115e29aa376c0f9758cdf0f5",
+		},
+	}}
+	require.NoError(t, s.Reload(s.Config))
+	token, err := s.Config.MintToken(&state.Identity{User: "octocat"}, time.Hour)
+	require.NoError(t, err)
+
+	tests := []struct {
+		authorization string
+		status        int
+		body          string
+	}{
+		{authorization: "Bearer " + key, status: http.StatusOK, body: "deploy "},
+		{authorization: "Bearer " + token, status: http.StatusOK, body: "octocat "},
+		{authorization: "Bearer " + hash, status: http.StatusUnauthorized, body: "Unauthorized.\n"},
+		{authorization: "", status: http.StatusUnauthorized, body: "Unauthorized.\n"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "https://foo.example.com/", nil)
+		req.Header.Set("Accept", "application/json")
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		rw := httptest.NewRecorder()
+		s.reloadable().ServeHTTP(rw, req)
+		assert.Equal(t, test.status, rw.Code)
+		assert.Equal(t, test.body, rw.Body.String())
+	}
+}
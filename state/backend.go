@@ -0,0 +1,331 @@
+package state
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davars/sohop/globals"
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+)
+
+// A Backend stores sessions on the server for a Store created with
+// Options.Backend.  Sessions are stored by key, which is derived from the
+// session ID held in the cookie, and expire at their ExpiresAt.
+type Backend interface {
+	// Get returns the session stored under key, or nil if there isn't one or
+	// it has expired.
+	Get(key string) (*Session, error)
+
+	// Put stores session under key, replacing any existing session.
+	Put(key string, session *Session) error
+
+	// Replace stores session under key only if a session that hasn't expired
+	// is already stored there, and reports whether it did.  Renewing a
+	// session with Replace can't bring it back after it's been deleted.
+	Replace(key string, session *Session) (bool, error)
+
+	// Delete removes the session stored under key, if any.
+	Delete(key string) error
+
+	// List returns the sessions that haven't expired, by key.
+	List() (map[string]*Session, error)
+
+	// Close releases the backend's resources.
+	Close() error
+}
+
+// RevokeUser deletes all of user's sessions from b, and returns how many
+// there were.
+func RevokeUser(b Backend, user string) (int, error) {
+	sessions, err := b.List()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for key, session := range sessions {
+		if !strings.EqualFold(session.User, user) {
+			continue
+		}
+		if err := b.Delete(key); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// newID returns a new session ID.
+func newID() (string, error) {
+	var b [32]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+// backendKey returns the key a session with the given ID is stored under.
+// Hashing the ID means the keys can be listed without revealing IDs that could
+// be used to hijack the sessions.
+func backendKey(id string) string {
+	h := sha256.Sum256([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+func expired(session *Session, now time.Time) bool {
+	return session.ExpiresAt == nil || !now.Before(session.ExpiresAt.AsTime())
+}
+
+// pruneInterval is how often expired sessions are deleted from a backend.
+// Until then they take up space, but Get and List ignore them.
+const pruneInterval = 10 * time.Minute
+
+// A pruner deletes expired sessions every pruneInterval until it's stopped.
+type pruner struct {
+	done chan struct{}
+	once sync.Once
+}
+
+func startPruning(prune func() error) *pruner {
+	p := &pruner{done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				if err := prune(); err != nil {
+					slog.Default().Error("pruning sessions", "error", err)
+				}
+			}
+		}
+	}()
+	return p
+}
+
+func (p *pruner) stop() {
+	p.once.Do(func() { close(p.done) })
+}
+
+type memoryBackend struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	pruner   *pruner
+}
+
+// NewMemoryBackend returns a Backend that keeps sessions in memory.  Sessions
+// are lost when the process exits.
+func NewMemoryBackend() Backend {
+	m := &memoryBackend{sessions: map[string]*Session{}}
+	m.pruner = startPruning(m.prune)
+	return m
+}
+
+func (m *memoryBackend) Get(key string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[key]
+	if !ok || expired(session, globals.Clock.Now()) {
+		return nil, nil
+	}
+	return proto.Clone(session).(*Session), nil
+}
+
+func (m *memoryBackend) Put(key string, session *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[key] = proto.Clone(session).(*Session)
+	return nil
+}
+
+func (m *memoryBackend) Replace(key string, session *Session) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if old, ok := m.sessions[key]; !ok || expired(old, globals.Clock.Now()) {
+		return false, nil
+	}
+	m.sessions[key] = proto.Clone(session).(*Session)
+	return true, nil
+}
+
+// prune deletes expired sessions.
+func (m *memoryBackend) prune() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := globals.Clock.Now()
+	for k, s := range m.sessions {
+		if expired(s, now) {
+			delete(m.sessions, k)
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, key)
+	return nil
+}
+
+func (m *memoryBackend) List() (map[string]*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := globals.Clock.Now()
+	sessions := map[string]*Session{}
+	for k, s := range m.sessions {
+		if !expired(s, now) {
+			sessions[k] = proto.Clone(s).(*Session)
+		}
+	}
+	return sessions, nil
+}
+
+func (m *memoryBackend) Close() error {
+	m.pruner.stop()
+	return nil
+}
+
+var sessionsBucket = []byte("sessions")
+
+type boltBackend struct {
+	db     *bolt.DB
+	pruner *pruner
+}
+
+// OpenBoltBackend returns a Backend that keeps sessions in the bbolt database
+// at path, creating it if it doesn't exist.  Only one process can have the
+// database open at a time.
+func OpenBoltBackend(path string) (Backend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	b := &boltBackend{db: db}
+	b.pruner = startPruning(b.prune)
+	return b, nil
+}
+
+func (b *boltBackend) Get(key string) (*Session, error) {
+	var session *Session
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(sessionsBucket).Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		session = &Session{}
+		return proto.Unmarshal(v, session)
+	})
+	if err != nil || session == nil || expired(session, globals.Clock.Now()) {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (b *boltBackend) Put(key string, session *Session) error {
+	v, err := proto.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte(key), v)
+	})
+}
+
+func (b *boltBackend) Replace(key string, session *Session) (bool, error) {
+	v, err := proto.Marshal(session)
+	if err != nil {
+		return false, err
+	}
+	replaced := false
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		old := bucket.Get([]byte(key))
+		if old == nil {
+			return nil
+		}
+		oldSession := &Session{}
+		if err := proto.Unmarshal(old, oldSession); err != nil || expired(oldSession, globals.Clock.Now()) {
+			return nil
+		}
+		replaced = true
+		return bucket.Put([]byte(key), v)
+	})
+	return replaced && err == nil, err
+}
+
+// prune deletes expired sessions.
+func (b *boltBackend) prune() error {
+	now := globals.Clock.Now()
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		var keys [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			session := &Session{}
+			if err := proto.Unmarshal(v, session); err != nil || expired(session, now) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltBackend) Delete(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Delete([]byte(key))
+	})
+}
+
+func (b *boltBackend) List() (map[string]*Session, error) {
+	now := globals.Clock.Now()
+	sessions := map[string]*Session{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).ForEach(func(k, v []byte) error {
+			session := &Session{}
+			if err := proto.Unmarshal(v, session); err != nil {
+				return err
+			}
+			if !expired(session, now) {
+				sessions[string(k)] = session
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (b *boltBackend) Close() error {
+	b.pruner.stop()
+	return b.db.Close()
+}
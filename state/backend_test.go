@@ -0,0 +1,200 @@
+package state
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	realclock "code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/clock/fakeclock"
+	"github.com/davars/sohop/globals"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestBackends(t *testing.T) {
+	backends := map[string]func(t *testing.T) Backend{
+		"memory": func(t *testing.T) Backend { return NewMemoryBackend() },
+		"bolt": func(t *testing.T) Backend {
+			b, err := OpenBoltBackend(filepath.Join(t.TempDir(), "sessions.db"))
+			require.NoError(t, err)
+			return b
+		},
+	}
+
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now()
+			clock := fakeclock.NewFakeClock(start)
+			globals.Clock = clock
+			defer func() { globals.Clock = realclock.NewClock() }()
+
+			b := open(t)
+			defer b.Close()
+
+			session, err := b.Get("missing")
+			assert.NoError(t, err)
+			assert.Nil(t, session)
+
+			require.NoError(t, b.Put("a", &Session{User: "alice", ExpiresAt: timestamppb.New(start.Add(time.Hour))}))
+			require.NoError(t, b.Put("b", &Session{User: "bob", ExpiresAt: timestamppb.New(start.Add(time.Minute))}))
+
+			session, err = b.Get("a")
+			require.NoError(t, err)
+			assert.Equal(t, "alice", session.User)
+
+			ok, err := b.Replace("a", &Session{User: "alice", Name: "Alice", ExpiresAt: timestamppb.New(start.Add(time.Hour))})
+			require.NoError(t, err)
+			assert.True(t, ok)
+			session, err = b.Get("a")
+			require.NoError(t, err)
+			assert.Equal(t, "Alice", session.Name)
+
+			ok, err = b.Replace("c", &Session{User: "carol", ExpiresAt: timestamppb.New(start.Add(time.Hour))})
+			require.NoError(t, err)
+			assert.False(t, ok)
+			session, err = b.Get("c")
+			assert.NoError(t, err)
+			assert.Nil(t, session)
+
+			sessions, err := b.List()
+			require.NoError(t, err)
+			assert.Len(t, sessions, 2)
+
+			clock.Increment(2 * time.Minute)
+			session, err = b.Get("b")
+			assert.NoError(t, err)
+			assert.Nil(t, session)
+			ok, err = b.Replace("b", &Session{User: "bob", ExpiresAt: timestamppb.New(start.Add(time.Hour))})
+			require.NoError(t, err)
+			assert.False(t, ok)
+			sessions, err = b.List()
+			require.NoError(t, err)
+			assert.Len(t, sessions, 1)
+			assert.Equal(t, "alice", sessions["a"].User)
+
+			// Expired sessions are kept until they're pruned.
+			assert.Equal(t, 2, stored(t, b))
+			require.NoError(t, b.(interface{ prune() error }).prune())
+			assert.Equal(t, 1, stored(t, b))
+
+			require.NoError(t, b.Delete("a"))
+			session, err = b.Get("a")
+			assert.NoError(t, err)
+			assert.Nil(t, session)
+		})
+	}
+}
+
+// stored returns the number of sessions stored in b, including expired ones.
+func stored(t *testing.T, b Backend) int {
+	switch b := b.(type) {
+	case *memoryBackend:
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.sessions)
+	case *boltBackend:
+		n := 0
+		require.NoError(t, b.db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket(sessionsBucket).Stats().KeyN
+			return nil
+		}))
+		return n
+	}
+	t.Fatalf("unknown backend %T", b)
+	return 0
+}
+
+func TestManager_RevokeBeforeTouch(t *testing.T) {
+	start := time.Now()
+	clock := fakeclock.NewFakeClock(start)
+	globals.Clock = clock
+	defer func() { globals.Clock = realclock.NewClock() }()
+
+	store, err := NewWithOptions("test", testSecret, "example.com", Options{IdleTimeout: time.Hour, Backend: NewMemoryBackend()})
+	require.NoError(t, err)
+	manager := store.(Manager)
+
+	rw := httptest.NewRecorder()
+	require.NoError(t, store.Authorize(rw, httptest.NewRequest("GET", "https://example.com/", nil), &Identity{User: "alice"}))
+	cookie := rw.Result().Cookies()[0]
+
+	clock.Increment(30 * time.Minute)
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+	req.AddCookie(cookie)
+	require.True(t, store.IsAuthorized(req))
+
+	// The session is revoked while the request is being handled.
+	_, err = manager.RevokeUser("alice")
+	require.NoError(t, err)
+	rw = httptest.NewRecorder()
+	require.NoError(t, store.Touch(rw, req))
+	assert.Empty(t, rw.Result().Cookies())
+
+	sessions, err := manager.Sessions()
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+	req = httptest.NewRequest("GET", "https://example.com/", nil)
+	req.AddCookie(cookie)
+	assert.False(t, store.IsAuthorized(req))
+}
+
+func TestManager(t *testing.T) {
+	backend := NewMemoryBackend()
+	store, err := NewWithOptions("test", testSecret, "example.com", Options{Backend: backend})
+	require.NoError(t, err)
+	require.Implements(t, (*Manager)(nil), store)
+	manager := store.(Manager)
+
+	login := func(user string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		require.NoError(t, store.Authorize(rw, httptest.NewRequest("GET", "https://example.com/", nil), &Identity{User: user}))
+		return rw
+	}
+	isAuthorized := func(rw *httptest.ResponseRecorder) bool {
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		for _, cookie := range rw.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		return store.IsAuthorized(req)
+	}
+
+	alice1, alice2, bob := login("alice"), login("Alice"), login("bob")
+	assert.True(t, isAuthorized(alice1))
+
+	// The cookie holds only the session ID.
+	id := alice1.Result().Cookies()[0].Value
+	sessions, err := manager.Sessions()
+	require.NoError(t, err)
+	assert.Len(t, sessions, 3)
+	assert.Equal(t, "alice", sessions[backendKey(id)].User)
+	assert.NotContains(t, sessions, id)
+
+	n, err := manager.RevokeUser("alice")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.False(t, isAuthorized(alice1))
+	assert.False(t, isAuthorized(alice2))
+	assert.True(t, isAuthorized(bob))
+
+	require.NoError(t, manager.Revoke(backendKey(bob.Result().Cookies()[0].Value)))
+	assert.False(t, isAuthorized(bob))
+
+	// Logging out deletes the session.
+	rw := login("carol")
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+	req.AddCookie(rw.Result().Cookies()[0])
+	require.NoError(t, store.Logout(httptest.NewRecorder(), req))
+	sessions, err = manager.Sessions()
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+
+	// Stores without a backend aren't Managers.
+	store, err = New("test", testSecret, "example.com")
+	require.NoError(t, err)
+	_, ok := store.(Manager)
+	assert.False(t, ok)
+}
@@ -10,21 +10,29 @@ import (
 
 	"github.com/davars/sohop/globals"
 	"github.com/davars/timebox"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 //go:generate protoc --proto_path=. --go_out=. --go_opt=paths=source_relative state.proto
 
 const (
-	sessionAge           = 24 * time.Hour
-	stateAge             = 5 * time.Minute
+	defaultSessionAge    = 24 * time.Hour
+	defaultStateAge      = 5 * time.Minute
 	maxRedirectURLLength = 2000
+
+	// maxCookieLength is the longest session cookie (name and value) that's
+	// set.  Browsers drop cookies longer than about 4096 bytes, including
+	// their attributes.
+	maxCookieLength = 4000
 )
 
 type contextKey int
 
 const (
 	sessionKey contextKey = iota
+	maxAgeKey
+	externalKey
 )
 
 func (c *cookieStore) GetSession(req *http.Request) (session *Session) {
@@ -46,14 +54,30 @@ func (c *cookieStore) GetSession(req *http.Request) (session *Session) {
 		return
 	}
 
+	if c.backend != nil {
+		session, err = c.backend.Get(backendKey(cookie.Value))
+		if err != nil {
+			globals.Logger(req.Context()).Error("getting session", "error", err)
+		}
+		return
+	}
+
 	session = &Session{}
-	if !c.boxer.Open(cookie.Value, session) {
+	if !c.open(cookie.Value, session) {
 		session = nil
 	}
 
 	return
 }
 
+// sessionID returns the ID in req's session cookie, if it has one.
+func (c *cookieStore) sessionID(req *http.Request) string {
+	if cookie, err := req.Cookie(c.name); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
 func (c *cookieStore) setCookie(rw http.ResponseWriter, name, value string, maxAge time.Duration) {
 	cookie := &http.Cookie{
 		Name:     name,
@@ -72,20 +96,159 @@ func (c *cookieStore) setCookie(rw http.ResponseWriter, name, value string, maxA
 	http.SetCookie(rw, cookie)
 }
 
-func (c *cookieStore) Authorize(rw http.ResponseWriter, req *http.Request, user string) error {
-	expires := globals.Clock.Now().Add(sessionAge)
-	expiresP := timestamppb.New(expires)
-	session := &Session{User: user, Authorized: true, ExpiresAt: expiresP}
-	value, err := c.boxer.Seal(session, sessionAge)
+// An Identity describes an authenticated user, as reported by an auth
+// provider.
+type Identity struct {
+	// User is the name the user is known by, e.g. a Github login.
+	User string
+
+	// Email is the user's email address, if known.
+	Email string
+
+	// Name is the user's display name, if known.
+	Name string
+
+	// Groups lists the groups or teams the user is a member of, if known.
+	Groups []string
+
+	// Claims holds any other values reported by the provider.
+	Claims map[string]string
+}
+
+// newSession returns an authorized session for id, who logged in at now.
+func newSession(id *Identity, now time.Time) *Session {
+	return &Session{
+		User:            id.User,
+		Email:           id.Email,
+		Name:            id.Name,
+		Groups:          id.Groups,
+		Claims:          id.Claims,
+		Authorized:      true,
+		AuthenticatedAt: timestamppb.New(now),
+	}
+}
+
+func (c *cookieStore) Authorize(rw http.ResponseWriter, req *http.Request, id *Identity) error {
+	now := globals.Clock.Now()
+	session := newSession(id, now)
+	if c.backend != nil {
+		// Logging in again starts a new session.
+		if id := c.sessionID(req); id != "" {
+			if err := c.backend.Delete(backendKey(id)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.seal(rw, "", session, now, c.expiry(session, now)); err != nil {
+		return err
+	}
+	*req = *req.WithContext(context.WithValue(req.Context(), sessionKey, session))
+	return nil
+}
+
+// expiry returns when session should expire if it's used at now: after the
+// idle timeout, but no later than the session age after the user logged in.
+func (c *cookieStore) expiry(session *Session, now time.Time) time.Time {
+	expires := session.AuthenticatedAt.AsTime().Add(c.opts.SessionAge)
+	if c.opts.IdleTimeout > 0 && now.Add(c.opts.IdleTimeout).Before(expires) {
+		expires = now.Add(c.opts.IdleTimeout)
+	}
+	return expires
+}
+
+// seal sets the session cookie to session, expiring at expires.  With a
+// Backend, session is stored under id (or a new ID if id is "") and the cookie
+// holds only the ID.  An existing id is only renewed if its session is still
+// stored, so a session revoked in the meantime stays revoked.
+func (c *cookieStore) seal(rw http.ResponseWriter, id string, session *Session, now, expires time.Time) error {
+	session.ExpiresAt = timestamppb.New(expires)
+	age := expires.Sub(now)
+
+	if c.backend != nil {
+		if id == "" {
+			var err error
+			if id, err = newID(); err != nil {
+				return err
+			}
+			if err := c.backend.Put(backendKey(id), session); err != nil {
+				return err
+			}
+		} else if ok, err := c.backend.Replace(backendKey(id), session); err != nil || !ok {
+			return err
+		}
+		c.setCookie(rw, c.name, id, age)
+		return nil
+	}
+
+	value, err := c.boxers[0].Seal(session, age)
 	if err != nil {
 		return err
 	}
-	c.setCookie(rw, c.name, value, sessionAge)
+	if n := len(c.name) + len(value); n > maxCookieLength {
+		return fmt.Errorf("session cookie for %q would be %d bytes, more than the %d browsers accept", session.User, n, maxCookieLength)
+	}
+	c.setCookie(rw, c.name, value, age)
+	return nil
+}
+
+// Touch renews the session's idle timeout.  To avoid resealing the cookie on
+// every request, it's only renewed once the expiry would move by more than a
+// tenth of the timeout.
+func (c *cookieStore) Touch(rw http.ResponseWriter, req *http.Request) error {
+	if req.Context().Value(externalKey) != nil {
+		return nil
+	}
+	session := c.GetSession(req)
+	if c.opts.IdleTimeout <= 0 || !session.Authorized || session.AuthenticatedAt == nil {
+		return nil
+	}
+
+	now := globals.Clock.Now()
+	expires := c.expiry(session, now)
+	if expires.Sub(session.ExpiresAt.AsTime()) <= c.opts.IdleTimeout/10 {
+		return nil
+	}
+	return c.seal(rw, c.sessionID(req), session, now, expires)
+}
+
+func (c *cookieStore) Logout(rw http.ResponseWriter, req *http.Request) error {
+	if id := c.sessionID(req); c.backend != nil && id != "" {
+		if err := c.backend.Delete(backendKey(id)); err != nil {
+			return err
+		}
+	}
+	c.setCookie(rw, c.name, "", -1)
+	*req = *req.WithContext(context.WithValue(req.Context(), sessionKey, &Session{}))
 	return nil
 }
 
 func (c *cookieStore) IsAuthorized(req *http.Request) bool {
-	return c.GetSession(req).Authorized
+	session := c.GetSession(req)
+	if !session.Authorized {
+		return false
+	}
+	if maxAge, ok := req.Context().Value(maxAgeKey).(time.Duration); ok {
+		if session.AuthenticatedAt == nil || globals.Clock.Since(session.AuthenticatedAt.AsTime()) > maxAge {
+			return false
+		}
+	}
+	return true
+}
+
+// WithMaxAge returns a shallow copy of req for which IsAuthorized only
+// reports the session as authorized if the user logged in within maxAge.
+func WithMaxAge(req *http.Request, maxAge time.Duration) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), maxAgeKey, maxAge))
+}
+
+// WithIdentity returns a shallow copy of req whose session is an authorized
+// session for id, for requests authenticated by means other than the session
+// cookie (e.g. an API key).  The session isn't persisted, and Touch ignores
+// it.
+func WithIdentity(req *http.Request, id *Identity) *http.Request {
+	ctx := context.WithValue(req.Context(), sessionKey, newSession(id, globals.Clock.Now()))
+	ctx = context.WithValue(ctx, externalKey, true)
+	return req.WithContext(ctx)
 }
 
 // stateKeyLen is used to split the state into the portion used for the state param in the oauth flow, and the remainder
@@ -97,12 +260,12 @@ func (c *cookieStore) CreateState(rw http.ResponseWriter, redirectURL string) (s
 		return "", fmt.Errorf("redirectURL %s... is too long", redirectURL[:maxRedirectURLLength])
 	}
 
-	state, err := c.boxer.Seal(&OAuthState{RedirectUrl: redirectURL}, stateAge)
+	state, err := c.boxers[0].Seal(&OAuthState{RedirectUrl: redirectURL}, c.opts.StateAge)
 	if err != nil {
 		return "", err
 	}
 	stateKey := state[:stateKeyLen]
-	c.setCookie(rw, stateKey, state[stateKeyLen:], stateAge)
+	c.setCookie(rw, stateKey, state[stateKeyLen:], c.opts.StateAge)
 	return stateKey, nil
 }
 
@@ -112,7 +275,7 @@ func (c *cookieStore) RedeemState(rw http.ResponseWriter, req *http.Request, sta
 		return "", err
 	}
 	os := &OAuthState{}
-	if !c.boxer.Open(stateKey+cookie.Value, os) {
+	if !c.open(stateKey+cookie.Value, os) {
 		return "", fmt.Errorf("invalid state")
 	}
 	c.setCookie(rw, stateKey, "", -1)
@@ -120,21 +283,103 @@ func (c *cookieStore) RedeemState(rw http.ResponseWriter, req *http.Request, sta
 }
 
 type cookieStore struct {
-	name   string
-	domain string
-	boxer  *timebox.Boxer
+	name    string
+	domain  string
+	opts    Options
+	backend Backend
+
+	// boxers[0] seals new values; all of them are tried when opening values.
+	boxers []*timebox.Boxer
+}
+
+// open decrypts sealed into output using any of the store's secrets.
+func (c *cookieStore) open(sealed string, output proto.Message) bool {
+	for _, boxer := range c.boxers {
+		if boxer.Open(sealed, output) {
+			return true
+		}
+	}
+	return false
 }
 
 type Store interface {
-	Authorize(http.ResponseWriter, *http.Request, string) error
+	Authorize(http.ResponseWriter, *http.Request, *Identity) error
+	Logout(http.ResponseWriter, *http.Request) error
 	IsAuthorized(*http.Request) bool
 	CreateState(http.ResponseWriter, string) (string, error)
 	RedeemState(http.ResponseWriter, *http.Request, string) (string, error)
 	GetSession(*http.Request) *Session
+
+	// Touch renews the session's idle timeout, if there is one.
+	Touch(http.ResponseWriter, *http.Request) error
+}
+
+// A Manager is a Store that keeps sessions on the server (see
+// Options.Backend), so they can be listed and revoked.
+type Manager interface {
+	Store
+
+	// Sessions returns the active sessions by key.  Keys identify sessions,
+	// but can't be used in place of the session cookie.
+	Sessions() (map[string]*Session, error)
+
+	// Revoke ends the session with the given key.
+	Revoke(key string) error
+
+	// RevokeUser ends all of user's sessions, and returns how many there were.
+	RevokeUser(user string) (int, error)
+}
+
+// A managedStore is a cookieStore with a Backend.
+type managedStore struct {
+	*cookieStore
+}
+
+func (m managedStore) Sessions() (map[string]*Session, error) {
+	return m.backend.List()
+}
+
+func (m managedStore) Revoke(key string) error {
+	return m.backend.Delete(key)
+}
+
+func (m managedStore) RevokeUser(user string) (int, error) {
+	return RevokeUser(m.backend, user)
+}
+
+// Options configures the lifetime of sessions and oauth states.
+type Options struct {
+	// SessionAge is how long a session lasts after the user logs in.
+	// Defaults to 24 hours.
+	SessionAge time.Duration
+
+	// IdleTimeout, if set, ends sessions that haven't been touched (see
+	// Store.Touch) for this long.
+	IdleTimeout time.Duration
+
+	// StateAge is how long the user has to complete an oauth flow.  Defaults
+	// to 5 minutes.
+	StateAge time.Duration
+
+	// PreviousSecrets are accepted when reading sessions and oauth states,
+	// but never used to create them, so the secret can be rotated without
+	// logging everyone out.
+	PreviousSecrets []string
+
+	// Backend, if set, stores sessions on the server, and the session cookie
+	// holds only an ID.  The store returned is a Manager.  The caller is
+	// responsible for closing the Backend.
+	Backend Backend
 }
 
 // New returns a new cookieStore to manage the oauth state and user sessions using encrypted cookies
 func New(name, secret, domain string) (Store, error) {
+	return NewWithOptions(name, secret, domain, Options{})
+}
+
+// NewWithOptions is like New, but configures the lifetime of sessions and
+// oauth states.
+func NewWithOptions(name, secret, domain string, opts Options) (Store, error) {
 	if name == "" {
 		return nil, fmt.Errorf("name cannot be empty")
 	}
@@ -142,13 +387,29 @@ func New(name, secret, domain string) (Store, error) {
 		return nil, fmt.Errorf("domain cannot be empty")
 	}
 
-	boxer, err := timebox.New(secret)
-	if err != nil {
-		return nil, err
+	var boxers []*timebox.Boxer
+	for _, secret := range append([]string{secret}, opts.PreviousSecrets...) {
+		boxer, err := timebox.New(secret)
+		if err != nil {
+			return nil, err
+		}
+		boxers = append(boxers, boxer)
+	}
+	if opts.SessionAge <= 0 {
+		opts.SessionAge = defaultSessionAge
+	}
+	if opts.StateAge <= 0 {
+		opts.StateAge = defaultStateAge
+	}
+	c := &cookieStore{
+		name:    name,
+		domain:  domain,
+		boxers:  boxers,
+		opts:    opts,
+		backend: opts.Backend,
+	}
+	if c.backend != nil {
+		return managedStore{c}, nil
 	}
-	return &cookieStore{
-		name:   name,
-		domain: domain,
-		boxer:  boxer,
-	}, nil
+	return c, nil
 }
@@ -6,8 +6,13 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	realclock "code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/clock/fakeclock"
+	"github.com/davars/sohop/globals"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const testSecret = "3c0767ada2466a92a59c1214061441713aeafe6d115e29aa376c0f9758cdf0f5"
@@ -62,10 +67,16 @@ func TestCookieStore_Session(t *testing.T) {
 	req, err := http.NewRequest("GET", "http://example.com", nil)
 	assert.NoError(t, err)
 
-	userName := "testUser"
+	id := &Identity{
+		User:   "testUser",
+		Email:  "test@example.com",
+		Name:   "Test User",
+		Groups: []string{"staff"},
+		Claims: map[string]string{"locale": "en"},
+	}
 
 	rw := httptest.NewRecorder()
-	err = store.Authorize(rw, req, userName)
+	err = store.Authorize(rw, req, id)
 	assert.NoError(t, err)
 
 	cookieHeader := rw.HeaderMap["Set-Cookie"]
@@ -78,9 +89,19 @@ func TestCookieStore_Session(t *testing.T) {
 	}
 	sealed := strings.Replace(strings.Split(cookie, ";")[0], "test=", "", 1)
 	session := &Session{}
-	assert.True(t, store.(*cookieStore).boxer.Open(sealed, session))
+	assert.True(t, store.(*cookieStore).open(sealed, session))
 	assert.True(t, session.Authorized)
-	assert.Equal(t, userName, session.User)
+	assert.Equal(t, id.User, session.User)
+	assert.Equal(t, id.Email, session.Email)
+	assert.Equal(t, id.Name, session.Name)
+	assert.Equal(t, id.Groups, session.Groups)
+	assert.Equal(t, id.Claims, session.Claims)
+
+	// Browsers would drop a cookie this large.
+	id.Claims = map[string]string{"groups": strings.Repeat("g", 4000)}
+	rw = httptest.NewRecorder()
+	assert.Error(t, store.Authorize(rw, req, id))
+	assert.Empty(t, rw.Header().Get("Set-Cookie"))
 }
 
 func TestCookieStore_State(t *testing.T) {
@@ -103,7 +124,7 @@ func TestCookieStore_State(t *testing.T) {
 	}
 	sealed := stateKey + strings.Replace(strings.Split(cookie, ";")[0], stateKey+"=", "", 1)
 	oauthState := &OAuthState{}
-	assert.True(t, store.(*cookieStore).boxer.Open(sealed, oauthState))
+	assert.True(t, store.(*cookieStore).open(sealed, oauthState))
 	assert.Equal(t, redirectURL, oauthState.RedirectUrl)
 
 	req, err := http.NewRequest("GET", "http://example.com", nil)
@@ -114,3 +135,117 @@ func TestCookieStore_State(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, redirectURL, state)
 }
+
+func TestCookieStore_Logout(t *testing.T) {
+	store, err := New("test", testSecret, "example.com")
+	assert.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://example.com", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Authorize(rw, req, &Identity{User: "testUser"}))
+
+	req, err = http.NewRequest("GET", "http://example.com", nil)
+	assert.NoError(t, err)
+	req.Header.Add("Cookie", rw.HeaderMap["Set-Cookie"][0])
+	assert.True(t, store.IsAuthorized(req))
+
+	rw = httptest.NewRecorder()
+	assert.NoError(t, store.Logout(rw, req))
+	assert.False(t, store.IsAuthorized(req))
+
+	cookieHeader := rw.HeaderMap["Set-Cookie"]
+	assert.Equal(t, 1, len(cookieHeader))
+	for _, s := range []string{"test=;", "Domain=example.com; Expires=Thu, 01 Jan 1970 00:00:00 GMT"} {
+		if !strings.Contains(cookieHeader[0], s) {
+			t.Fatalf("expected cookie to contain %q\nwas: %q", s, cookieHeader[0])
+		}
+	}
+}
+
+func TestCookieStore_Lifetime(t *testing.T) {
+	start := time.Now()
+	clock := fakeclock.NewFakeClock(start)
+	globals.Clock = clock
+	defer func() { globals.Clock = realclock.NewClock() }()
+
+	store, err := NewWithOptions("test", testSecret, "example.com", Options{SessionAge: 8 * time.Hour, IdleTimeout: time.Hour})
+	assert.NoError(t, err)
+
+	// request returns a request carrying the cookies set on rw.
+	request := func(rw *httptest.ResponseRecorder) *http.Request {
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		for _, cookie := range rw.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+
+	rw := httptest.NewRecorder()
+	assert.NoError(t, store.Authorize(rw, httptest.NewRequest("GET", "https://example.com/", nil), &Identity{User: "testUser"}))
+	assert.Equal(t, 3600, rw.Result().Cookies()[0].MaxAge)
+	login := rw
+
+	// Recently renewed sessions aren't resealed.
+	clock.Increment(time.Minute)
+	rw = httptest.NewRecorder()
+	assert.NoError(t, store.Touch(rw, request(login)))
+	assert.Empty(t, rw.Result().Cookies())
+
+	clock.Increment(29 * time.Minute)
+	rw = httptest.NewRecorder()
+	assert.NoError(t, store.Touch(rw, request(login)))
+	require.Len(t, rw.Result().Cookies(), 1)
+	assert.Equal(t, 3600, rw.Result().Cookies()[0].MaxAge)
+	session := store.GetSession(request(rw))
+	assert.True(t, session.Authorized)
+	assert.Equal(t, start.Add(90*time.Minute).Unix(), session.ExpiresAt.AsTime().Unix())
+	assert.Equal(t, start.Unix(), session.AuthenticatedAt.AsTime().Unix())
+
+	// Renewal never extends the session beyond SessionAge.
+	clock.Increment(7 * time.Hour)
+	rw = httptest.NewRecorder()
+	assert.NoError(t, store.Touch(rw, request(login)))
+	require.Len(t, rw.Result().Cookies(), 1)
+	assert.Equal(t, 1800, rw.Result().Cookies()[0].MaxAge)
+
+	// WithMaxAge requires a more recent login.
+	req := request(login)
+	assert.True(t, store.IsAuthorized(req))
+	assert.True(t, store.IsAuthorized(WithMaxAge(req, 8*time.Hour)))
+	assert.False(t, store.IsAuthorized(WithMaxAge(req, time.Hour)))
+}
+
+func TestCookieStore_Rotation(t *testing.T) {
+	const newSecret = "0f5e29aa376c0f9758cdf0f53c0767ada2466a92a59c1214061441713aeafe6d"
+
+	old, err := New("test", testSecret, "example.com")
+	require.NoError(t, err)
+	rw := httptest.NewRecorder()
+	require.NoError(t, old.Authorize(rw, httptest.NewRequest("GET", "https://example.com/", nil), &Identity{User: "testUser"}))
+	session := rw.Result().Cookies()[0]
+	rw = httptest.NewRecorder()
+	stateKey, err := old.CreateState(rw, "https://example.com/")
+	require.NoError(t, err)
+	state := rw.Result().Cookies()[0]
+
+	rotated, err := NewWithOptions("test", newSecret, "example.com", Options{PreviousSecrets: []string{testSecret}})
+	require.NoError(t, err)
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+	req.AddCookie(session)
+	req.AddCookie(state)
+	assert.True(t, rotated.IsAuthorized(req))
+	redirectURL, err := rotated.RedeemState(httptest.NewRecorder(), req, stateKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/", redirectURL)
+
+	// New sessions are sealed with the new secret only.
+	rw = httptest.NewRecorder()
+	require.NoError(t, rotated.Authorize(rw, httptest.NewRequest("GET", "https://example.com/", nil), &Identity{User: "testUser"}))
+	req = httptest.NewRequest("GET", "https://example.com/", nil)
+	req.AddCookie(rw.Result().Cookies()[0])
+	assert.False(t, old.IsAuthorized(req))
+
+	_, err = NewWithOptions("test", newSecret, "example.com", Options{PreviousSecrets: []string{"bad"}})
+	assert.Error(t, err)
+}
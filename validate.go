@@ -0,0 +1,309 @@
+package sohop
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/davars/sohop/auth"
+	"github.com/davars/sohop/state"
+)
+
+// A ConfigError is a problem with a single value in a Config.
+type ConfigError struct {
+	// Path is the location of the value in the config file, e.g.
+	// "Upstreams.foo.Headers.X-User[0]".
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+// ConfigErrors is the list of problems found by Config.Validate.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+var (
+	subdomainRE        = regexp.MustCompile(`^[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+	reservedSubdomains = []string{"oauth", "health"}
+)
+
+// Validate performs the checks Run performs before starting the server, and
+// returns every problem found as ConfigErrors.
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	add := func(path string, err error) {
+		errs = append(errs, &ConfigError{Path: path, Err: err})
+	}
+
+	if c.Domain == "" {
+		add("Domain", errors.New("required"))
+	}
+	if c.Github != nil {
+		add("Github", errors.New(`deprecated, refer to the README regarding the "Auth" key`))
+	}
+	if c.Google != nil {
+		add("Google", errors.New(`deprecated, refer to the README regarding the "Auth" key`))
+	}
+
+	if c.Auth.Type == "" {
+		add("Auth.Type", errors.New("required"))
+	} else if a, err := auth.NewAuther(c.Auth); err != nil {
+		add("Auth", err)
+	} else if gh, ok := a.(*auth.GithubAuth); ok && len(gh.Teams) > 0 && gh.Org == "" {
+		add("Auth.Config.Teams", errors.New("requires Org"))
+	}
+
+	if c.Cookie.Secret != "" {
+		if _, err := state.New("_", c.Cookie.Secret, "_"); err != nil {
+			add("Cookie.Secret", err)
+		}
+	}
+	for i, secret := range c.Cookie.Secrets {
+		if _, err := state.New("_", secret, "_"); err != nil {
+			add(fmt.Sprintf("Cookie.Secrets[%d]", i), err)
+		}
+	}
+	generated := c.Cookie.Secret == "" && len(c.Cookie.Secrets) == 0 && !c.Cookie.Replicated
+	if c.Cookie.SecretFile != "" {
+		secrets, err := CookieConfig{SecretFile: c.Cookie.SecretFile}.secrets()
+		if errors.Is(err, fs.ErrNotExist) && generated {
+			// storeConfig creates it.
+			err = nil
+		} else if err == nil && len(secrets) == 0 {
+			err = errors.New("no secrets found")
+		}
+		for _, secret := range secrets {
+			if _, err = state.New("_", secret, "_"); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			add("Cookie.SecretFile", err)
+		}
+	} else if c.Cookie.Replicated && c.Cookie.Secret == "" && len(c.Cookie.Secrets) == 0 {
+		add("Cookie", errors.New("Replicated requires Secret, Secrets or SecretFile"))
+	}
+
+	for _, d := range []struct {
+		path  string
+		value Duration
+	}{
+		{"Session.MaxAge", c.Session.MaxAge},
+		{"Session.IdleTimeout", c.Session.IdleTimeout},
+		{"Session.LoginTimeout", c.Session.LoginTimeout},
+	} {
+		if d.value < 0 {
+			add(d.path, errors.New("must not be negative"))
+		}
+	}
+	if c.Session.MaxAge > 0 && c.Session.IdleTimeout > c.Session.MaxAge {
+		add("Session.IdleTimeout", errors.New("must not exceed MaxAge"))
+	}
+
+	switch c.Session.Store.Type {
+	case "", StoreCookie, StoreMemory:
+	case StoreBolt:
+		if c.Session.Store.Path == "" {
+			add("Session.Store.Path", errors.New(`required for the "bolt" store`))
+		} else if _, err := os.Stat(filepath.Dir(c.Session.Store.Path)); err != nil {
+			add("Session.Store.Path", err)
+		}
+	default:
+		add("Session.Store.Type", fmt.Errorf("unknown session store %q", c.Session.Store.Type))
+	}
+
+	if _, err := c.bearerAuth(); err != nil {
+		add("Bearer", err)
+	}
+
+	if c.Assertion.KeyFile != "" {
+		if _, err := c.Assertion.readKeys(); err != nil {
+			add("Assertion.KeyFile", err)
+		}
+	}
+
+	for i, proxy := range c.TrustedProxies {
+		if _, err := parseTrustedProxy(proxy); err != nil {
+			add(fmt.Sprintf("TrustedProxies[%d]", i), err)
+		}
+	}
+
+	if _, err := c.Log.logger(); err != nil {
+		add("Log", err)
+	}
+
+	if c.Audit.Path != "" && c.Audit.Path != "-" {
+		if _, err := os.Stat(filepath.Dir(c.Audit.Path)); err != nil {
+			add("Audit.Path", err)
+		}
+	}
+
+	if c.Acme == nil {
+		if c.TLS.CertFile == "" || c.TLS.CertKey == "" {
+			add("TLS", errors.New("CertFile and CertKey are required unless Acme is configured"))
+		} else if _, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.CertKey); err != nil {
+			add("TLS", err)
+		}
+	}
+	if _, err := c.TLS.clientCAs(); err != nil {
+		add("TLS.ClientCAFile", err)
+	}
+	if _, err := c.certAuth(); err != nil {
+		add("TLS.ClientCertUser", err)
+	}
+
+	if c.Admin != nil {
+		subdomain := c.Admin.subdomain()
+		if !subdomainRE.MatchString(subdomain) {
+			add("Admin.Subdomain", fmt.Errorf("%q is not a valid subdomain", subdomain))
+		}
+		for _, reserved := range reservedSubdomains {
+			if strings.EqualFold(subdomain, reserved) {
+				add("Admin.Subdomain", fmt.Errorf("the %q subdomain is reserved", reserved))
+			}
+		}
+		for name := range c.Upstreams {
+			if strings.EqualFold(subdomain, name) {
+				add("Admin.Subdomain", fmt.Errorf("%q is also the name of an upstream", subdomain))
+			}
+		}
+		if c.Admin.Policy == nil {
+			add("Admin.Policy", errors.New("required"))
+		}
+		validatePolicy("Admin.Policy", c.Admin.Policy, add)
+	}
+
+	names := make([]string, 0, len(c.Upstreams))
+	for name := range c.Upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.Upstreams[name].validate("Upstreams."+name, name, add)
+		if c.Upstreams[name].ClientCert && c.TLS.ClientCAFile == "" {
+			add("Upstreams."+name+".ClientCert", errors.New("requires TLS.ClientCAFile"))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (spec UpstreamConfig) validate(path, name string, add func(string, error)) {
+	if !subdomainRE.MatchString(name) {
+		add(path, errors.New("not a valid subdomain"))
+	}
+	for _, reserved := range reservedSubdomains {
+		if strings.EqualFold(name, reserved) {
+			add(path, fmt.Errorf("the %q subdomain is reserved", reserved))
+		}
+	}
+
+	if spec.URL == "" && len(spec.URLs) == 0 && spec.WebSocket == "" && len(spec.Routes) == 0 {
+		add(path, errors.New("one of URL, URLs, WebSocket or Routes is required"))
+	}
+	validateRoute(path, RouteConfig{
+		URL:         spec.URL,
+		URLs:        spec.URLs,
+		Balance:     spec.Balance,
+		HealthCheck: spec.HealthCheck,
+		WebSocket:   spec.WebSocket,
+	}, add)
+
+	paths := map[string]bool{}
+	for i, rt := range spec.Routes {
+		routePath := fmt.Sprintf("%s.Routes[%d]", path, i)
+		prefix := rt.Path
+		if prefix == "" {
+			prefix = "/"
+		}
+		if !strings.HasPrefix(prefix, "/") {
+			add(routePath+".Path", fmt.Errorf("%q must start with /", rt.Path))
+		}
+		if paths[prefix] {
+			add(routePath+".Path", fmt.Errorf("duplicate route for %q", prefix))
+		}
+		paths[prefix] = true
+		if rt.URL == "" && len(rt.URLs) == 0 && rt.WebSocket == "" {
+			add(routePath, errors.New("one of URL, URLs or WebSocket is required"))
+		}
+		validateRoute(routePath, rt, add)
+	}
+
+	if spec.SessionMaxAge < 0 {
+		add(path+".SessionMaxAge", errors.New("must not be negative"))
+	}
+	if spec.Assertion != nil && spec.Assertion.TTL < 0 {
+		add(path+".Assertion.TTL", errors.New("must not be negative"))
+	}
+
+	if _, err := spec.TLS.tlsConfig(); err != nil {
+		add(path+".TLS", err)
+	}
+
+	validatePolicy(path+".Policy", spec.Policy, add)
+	validateHeaderTemplates(path+".Headers", spec.Headers, add)
+	validateHeaderTemplates(path+".ResponseHeaders", spec.ResponseHeaders, add)
+}
+
+func validateRoute(path string, rt RouteConfig, add func(string, error)) {
+	if rt.URL != "" {
+		if err := checkURL(rt.URL, "http", "https"); err != nil {
+			add(path+".URL", err)
+		}
+	}
+	for i, u := range rt.URLs {
+		if err := checkURL(u, "http", "https"); err != nil {
+			add(fmt.Sprintf("%s.URLs[%d]", path, i), err)
+		}
+	}
+	switch rt.Balance {
+	case "", RoundRobin, LeastConnections, Random:
+	default:
+		add(path+".Balance", fmt.Errorf("unknown balance strategy %q", rt.Balance))
+	}
+	if rt.HealthCheck != "" {
+		if _, err := url.Parse(rt.HealthCheck); err != nil {
+			add(path+".HealthCheck", err)
+		}
+	}
+	if rt.WebSocket != "" {
+		if err := checkURL(rt.WebSocket, "ws", "wss"); err != nil {
+			add(path+".WebSocket", err)
+		}
+	}
+}
+
+// checkURL returns an error unless rawURL is an absolute URL with one of the
+// given schemes.
+func checkURL(rawURL string, schemes ...string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme && u.Host != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not an absolute %s URL", rawURL, strings.Join(schemes, " or "))
+}
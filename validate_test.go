@@ -0,0 +1,211 @@
+package sohop
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/davars/sohop/acme"
+	"github.com/davars/sohop/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	valid := func() *Config {
+		return &Config{
+			Domain:    "example.com",
+			Upstreams: map[string]UpstreamConfig{"foo": {URL: "http://127.0.0.1:8080"}},
+			Auth:      auth.Config{Type: "mock", Config: json.RawMessage(`{}`)},
+			TLS:       TLSConfig{CertFile: "fixtures/cert.pem", CertKey: "fixtures/key.pem"},
+		}
+	}
+
+	tests := map[string]struct {
+		modify func(c *Config)
+		errs   []string
+	}{
+		"valid": {
+			modify: func(c *Config) {},
+		},
+		"acme": {
+			modify: func(c *Config) { c.TLS = TLSConfig{}; c.Acme = &acme.Config{} },
+		},
+		"everything": {
+			modify: func(c *Config) {
+				c.Domain = ""
+				c.Auth.Type = "facebook"
+				c.TLS.CertFile = "fixtures/missing.pem"
+				c.Upstreams = map[string]UpstreamConfig{
+					"foo": {
+						URL:       "localhost:8080",
+						URLs:      []string{"http://127.0.0.1:8081", "http://[::1"},
+						Balance:   "fastest",
+						WebSocket: "http://127.0.0.1:8080",
+						Headers:   http.Header{"X-User": {"{{.Session.User}}", "{{.Session.User"}},
+						TLS:       &UpstreamTLSConfig{CAFile: "fixtures/missing.pem"},
+						Routes: []RouteConfig{
+							{Path: "api", URL: "http://127.0.0.1:9000"},
+							{Path: "/"},
+						},
+					},
+					"oauth":   {URL: "http://127.0.0.1:8080"},
+					"bad_one": {URL: "http://127.0.0.1:8080"},
+				}
+			},
+			errs: []string{
+				"Domain: required",
+				`Auth: unknown auther type "facebook"`,
+				"TLS: open fixtures/missing.pem: no such file or directory",
+				"Upstreams.bad_one: not a valid subdomain",
+				`Upstreams.foo.URL: "localhost:8080" is not an absolute http or https URL`,
+				`Upstreams.foo.URLs[1]: parse "http://[::1": missing ']' in host`,
+				`Upstreams.foo.Balance: unknown balance strategy "fastest"`,
+				`Upstreams.foo.WebSocket: "http://127.0.0.1:8080" is not an absolute ws or wss URL`,
+				`Upstreams.foo.Routes[0].Path: "api" must start with /`,
+				"Upstreams.foo.Routes[1]: one of URL, URLs or WebSocket is required",
+				"Upstreams.foo.TLS: open fixtures/missing.pem: no such file or directory",
+				"Upstreams.foo.Headers.X-User[1]: template: :1: unclosed action",
+				`Upstreams.oauth: the "oauth" subdomain is reserved`,
+			},
+		},
+		"cookie secret": {
+			modify: func(c *Config) { c.Cookie.Secret = "hunter2" },
+			errs:   []string{"Cookie.Secret: "},
+		},
+		"cookie secrets": {
+			modify: func(c *Config) {
+				c.Cookie.Secrets = []string{"3c0767ada2466a92a59c1214061441713aeafe6d115e29aa376c0f9758cdf0f5", "hunter2"}
+				c.Cookie.SecretFile = "fixtures/missing"
+			},
+			errs: []string{
+				"Cookie.Secrets[1]: ",
+				"Cookie.SecretFile: open fixtures/missing: no such file or directory",
+			},
+		},
+		"replicated cookie": {
+			modify: func(c *Config) { c.Cookie.Replicated = true },
+			errs:   []string{"Cookie: Replicated requires Secret, Secrets or SecretFile"},
+		},
+		"replicated cookie secret file": {
+			modify: func(c *Config) {
+				c.Cookie.Replicated = true
+				c.Cookie.SecretFile = "fixtures/missing"
+			},
+			errs: []string{"Cookie.SecretFile: open fixtures/missing: no such file or directory"},
+		},
+		"log": {
+			modify: func(c *Config) { c.Log = LogConfig{Format: "xml", Level: "loud"} },
+			errs:   []string{`Log: unknown level "loud"`},
+		},
+		"session": {
+			modify: func(c *Config) {
+				c.Session = SessionConfig{MaxAge: Duration(time.Hour), IdleTimeout: Duration(2 * time.Hour), LoginTimeout: -1}
+				c.Upstreams["foo"] = UpstreamConfig{URL: "http://127.0.0.1:8080", SessionMaxAge: Duration(-time.Minute)}
+			},
+			errs: []string{
+				"Session.LoginTimeout: must not be negative",
+				"Session.IdleTimeout: must not exceed MaxAge",
+				"Upstreams.foo.SessionMaxAge: must not be negative",
+			},
+		},
+		"session store": {
+			modify: func(c *Config) { c.Session.Store = SessionStoreConfig{Type: "redis"} },
+			errs:   []string{`Session.Store.Type: unknown session store "redis"`},
+		},
+		"bolt store": {
+			modify: func(c *Config) { c.Session.Store = SessionStoreConfig{Type: "bolt", Path: "missing/sessions.db"} },
+			errs:   []string{"Session.Store.Path: stat missing: no such file or directory"},
+		},
+		"admin": {
+			modify: func(c *Config) { c.Admin = &AdminConfig{Subdomain: "foo"} },
+			errs: []string{
+				`Admin.Subdomain: "foo" is also the name of an upstream`,
+				"Admin.Policy: required",
+			},
+		},
+		"admin subdomain": {
+			modify: func(c *Config) {
+				c.Admin = &AdminConfig{Subdomain: "health", Policy: &Policy{Users: []string{"octocat"}}}
+			},
+			errs: []string{`Admin.Subdomain: the "health" subdomain is reserved`},
+		},
+		"empty policy": {
+			modify: func(c *Config) {
+				c.Admin = &AdminConfig{Policy: &Policy{}}
+				c.Upstreams["foo"] = UpstreamConfig{URL: "http://127.0.0.1:8080", Policy: &Policy{}}
+			},
+			errs: []string{
+				"Admin.Policy: matches no one",
+				"Upstreams.foo.Policy: matches no one",
+			},
+		},
+		"bearer": {
+			modify: func(c *Config) { c.Bearer.APIKeys = []auth.APIKey{{Hash: "hunter2", User: "deploy"}} },
+			errs:   []string{"Bearer: API key 0: hash should be a 64-character hex-encoded SHA-256 hash"},
+		},
+		"client certificates": {
+			modify: func(c *Config) {
+				c.TLS.ClientCAFile = "fixtures/config.json"
+				c.TLS.ClientCertUser = "serial"
+				c.Upstreams["foo"] = UpstreamConfig{URL: "http://127.0.0.1:8080", ClientCert: true}
+			},
+			errs: []string{
+				"TLS.ClientCAFile: no certificates found in fixtures/config.json",
+				`TLS.ClientCertUser: unknown client certificate field "serial"`,
+			},
+		},
+		"client certificates without a CA": {
+			modify: func(c *Config) { c.Upstreams["foo"] = UpstreamConfig{URL: "http://127.0.0.1:8080", ClientCert: true} },
+			errs:   []string{"Upstreams.foo.ClientCert: requires TLS.ClientCAFile"},
+		},
+		"assertion": {
+			modify: func(c *Config) {
+				c.Assertion.KeyFile = "fixtures/cert.pem"
+				c.Upstreams["foo"] = UpstreamConfig{URL: "http://127.0.0.1:8080", Assertion: &UpstreamAssertionConfig{TTL: -1}}
+			},
+			errs: []string{
+				`Assertion.KeyFile: unsupported PEM block "CERTIFICATE"`,
+				"Upstreams.foo.Assertion.TTL: must not be negative",
+			},
+		},
+		"trusted proxies": {
+			modify: func(c *Config) { c.TrustedProxies = []string{"10.0.0.0/8", "::1", "localhost"} },
+			errs:   []string{`TrustedProxies[2]: "localhost" is not an IP address or CIDR`},
+		},
+		"github teams": {
+			modify: func(c *Config) {
+				c.Auth = auth.Config{Type: "github-org", Config: json.RawMessage(`{"OrgID": 1, "Teams": ["ops"]}`)}
+			},
+			errs: []string{"Auth.Config.Teams: requires Org"},
+		},
+		"deprecated": {
+			modify: func(c *Config) { c.Github = json.RawMessage(`{}`) },
+			errs:   []string{`Github: deprecated, refer to the README regarding the "Auth" key`},
+		},
+		"empty upstream": {
+			modify: func(c *Config) { c.Upstreams["bar"] = UpstreamConfig{Auth: true} },
+			errs:   []string{"Upstreams.bar: one of URL, URLs, WebSocket or Routes is required"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := valid()
+			test.modify(c)
+			err := c.Validate()
+			if len(test.errs) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			require.IsType(t, ConfigErrors{}, err)
+			errs := err.(ConfigErrors)
+			require.Len(t, errs, len(test.errs), err.Error())
+			for i, e := range errs {
+				assert.Contains(t, e.Error(), test.errs[i])
+			}
+		})
+	}
+}